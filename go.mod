@@ -1,3 +1,11 @@
 module gofs
 
 go 1.18
+
+require (
+	github.com/yuin/goldmark v1.5.4
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.10.0
+)
+
+require golang.org/x/text v0.13.0 // indirect
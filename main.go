@@ -1,22 +1,46 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"log"
 	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
+
+	"github.com/yuin/goldmark"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/netutil"
 )
 
 // git克隆
@@ -39,10 +63,53 @@ import (
 // 解决alpine镜像问题, udp问题, 时区问题
 // RUN mkdir /lib64 && ln -s /lib/libc.musl-x86_64.so.1 /lib64/ld-linux-x86-64.so.2 && apk add -U util-linux && apk add -U tzdata && cp /usr/share/zoneinfo/Asia/Shanghai /etc/localtime  # 解决go语言程序无法在alpine执行的问题和syslog不支持udp的问题和时区问题
 
-const maxUploadSize = 32 * (2 << 30) // 32 * 1GB
+const maxFieldSize = 4 << 10 // form fields next to an uploaded file
+const maxTreeDepth = 64
+const maxTailLines = 10000
+const maxRandLength = 1 << 20
+const maxBodySize = 10 << 20 // decompressed request bodies of the utility endpoints
+
 var dir, host, port string
+var protocol = "http"
+var serverName string
+var Version = "dev"
+var startTime = time.Now()
+var autocertDomain, certDir string
+var authCred, metricsAuth string
+var authRules authRuleList
+var quiet404 bool
+var noSlashRedirect bool
+var maxConns int
+var logSample int
+var logCounter uint64
+var dupWarn bool
+var precompressed bool
+var autoIndex bool
+var scanCmd string
+var snapshot bool
+var maxDepth int
+var singleFile string
+var compressStore bool
+var allowReset bool
+var pushGateway string
+var pushInterval time.Duration
+var shutdownHooks []func()
+var drainTimeout time.Duration
+var snapshotDir string
+var pageSize int
+var emptyMessage string
+var readme bool
+var recordDir string
+var recordMax int64
+var recordCounter uint64
+var fileMode, dirMode = octalMode(0644), octalMode(0755)
+var organizeInterval time.Duration
+var gzipLevel int
+var metricsMu sync.Mutex
 var reqSeconds map[string]float64
 var reqTimes map[string]int64
+var dupNames = make(map[string]int)
+var downloads = make(map[string]int64)
 
 const html = `
 <!DOCTYPE html>
@@ -52,133 +119,254 @@ const html = `
   <meta charset="UTF-8" />
   <meta name="viewport" content="width=device-width, initial-scale=1.0" />
   <meta http-equiv="X-UA-Compatible" content="ie=edge" />
-  <title>File Share</title>
+  <title>{{.Name | html}}</title>
   <!-- <script src="./bfi.js"></script> -->
 </head>
 
 <body>
+  <h3>{{.Name | html}}</h3>
+{{- if .Motd}}
+  <p><strong>📢 {{.Motd | html}}</strong></p>
+{{- end}}
   <p><strong>CMD Method</strong></p>
-  <p>curl -X POST -F "path=bar" -F "file=@/root/foo/sample.pdf" {{.Protocol}}://{{.Host}}:{{.Port}}/upload</p>
-  <p>curl -X GET {{.Protocol}}://{{.Host}}:{{.Port}}/bar/sample.pdf</p>
-  <p>curl -X POST -d "filepath=bar/sample.pdf" {{.Protocol}}://{{.Host}}:{{.Port}}/delete</p>
+{{- if not .ReadOnly}}
+  <p>curl -X POST -F "path=bar" -F "file=@/root/foo/sample.pdf" {{.Protocol | html}}://{{.Host | html}}:{{.Port | html}}{{.Prefix | html}}/upload</p>
+{{- end}}
+  <p>curl -X GET {{.Protocol | html}}://{{.Host | html}}:{{.Port | html}}{{.Prefix | html}}/bar/sample.pdf</p>
+{{- if not .ReadOnly}}
+  <p>curl -X POST -d "filepath=bar/sample.pdf" {{.Protocol | html}}://{{.Host | html}}:{{.Port | html}}{{.Prefix | html}}/delete</p>
+{{- end}}
   <p><strong>WEB Method</strong></p>
-  <form enctype="multipart/form-data" action="{{.Protocol}}://{{.Host}}:{{.Port}}/upload" method="post" target="iiframe">
+{{- if .ReadOnly}}
+  <p>Uploads are disabled, this server is read-only.</p>
+  <a href="{{.Protocol | html}}://{{.Host | html}}:{{.Port | html}}{{.Prefix | html}}"><button type="button">Browse</button></a>
+{{- else}}
+  <form enctype="multipart/form-data" action="{{.Protocol | html}}://{{.Host | html}}:{{.Port | html}}{{.Prefix | html}}/upload" method="post" target="iiframe">
     <input name="path" placeholder="(Optional) remote storage path" size="30" />
     <input type="file" name="file" size="30" />
     <input type="submit" value="Upload" />
     <label> ¦ </label>
-    <a href="{{.Protocol}}://{{.Host}}:{{.Port}}"><button type="button">Browse</button></a>
+    <a href="{{.Protocol | html}}://{{.Host | html}}:{{.Port | html}}{{.Prefix | html}}"><button type="button">Browse</button></a>
   </form>
   <iframe id="iiframe" name="iiframe" frameborder="0" width="600px" height="50px" ></iframe>
+{{- end}}
   <!-- <iframe id="iiframe" name="iiframe" frameborder="0" style="display:none;"></iframe> -->
 </body>
 
 </html>
 `
 
+const listingHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="UTF-8" />
+  <meta name="viewport" content="width=device-width, initial-scale=1.0" />
+  <title>Index of {{.Path | html}} - {{.Name | html}}</title>
+</head>
+<body>
+  <h3>Index of {{.Path | html}}</h3>
+{{- if .Motd}}
+  <p><strong>📢 {{.Motd | html}}</strong></p>
+{{- end}}
+{{- if .Empty}}
+  <p>{{.Empty | html}}{{if .Upload}} <a href="upload">Upload a file</a>{{end}}</p>
+{{- else}}
+  <table>
+    <tr><th align="left">Name</th><th align="right">Size</th><th align="left">Modified</th></tr>
+{{- if .Parent}}
+    <tr><td><a href="{{.Parent}}">../</a></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Rows}}
+    <tr><td><a href="{{.Link | html}}">{{.Name | html}}</a>{{if .Warn}} ⚠ differs from another entry only by case{{end}}</td><td align="right">{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{.ModTime.Format "2006-01-02 15:04:05"}}</td></tr>
+{{- end}}
+  </table>
+{{- end}}
+{{- if gt .Pages 1}}
+  <p>
+    {{if .Prev}}<a href="{{.Prev | html}}">« prev</a>{{else}}« prev{{end}}
+    | page {{.Page}} of {{.Pages}} |
+    {{if .Next}}<a href="{{.Next | html}}">next »</a>{{else}}next »{{end}}
+  </p>
+{{- end}}
+{{- if .Readme}}
+  <hr />
+  <div class="readme">
+{{.Readme}}
+  </div>
+{{- end}}
+</body>
+</html>
+`
+
+const uploadedHTML = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8" /></head>
+<body>
+  <p>✔ Succeeded: <a href="{{.Link | html}}" target="_blank">{{.Name | html}}</a> ({{.Size}} bytes) stored at {{.Path | html}}</p>
+</body>
+</html>
+`
+
 func init() {
 	reqSeconds = make(map[string]float64)
 	reqTimes = make(map[string]int64)
+}
+
+// octal permission flag, e.g. -filemode 0644
+type octalMode os.FileMode
 
-	rand.Seed(time.Now().UnixNano())
+func (m *octalMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
 }
 
-type Server struct {
-	Protocol string
-	Host     string
-	Port     string
+func (m *octalMode) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0777 {
+		return fmt.Errorf("invalid permission %q: must be octal between 0 and 0777", s)
+	}
+	*m = octalMode(v)
+	return nil
 }
 
-// Gzip Compression
-type gzipResponseWriter struct {
-	io.Writer
-	http.ResponseWriter
+// create fullpath and its missing parents with -dirmode, every created directory
+// is chmodded as the mode given to MkdirAll is masked by the umask
+func mkdirAll(fullpath string) error {
+	var created []string
+	for p := filepath.Clean(fullpath); ; p = filepath.Dir(p) {
+		if _, err := os.Stat(p); err == nil || filepath.Dir(p) == p {
+			break
+		}
+		created = append(created, p)
+	}
+	if err := os.MkdirAll(fullpath, os.FileMode(dirMode)); err != nil {
+		return err
+	}
+	for _, p := range created {
+		if err := os.Chmod(p, os.FileMode(dirMode)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (w gzipResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
+// -authrule /prefix=required|optional, repeatable
+type authRule struct {
+	Prefix   string
+	Required bool
 }
 
-func Gzip(handler http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func(t time.Time) {
-			reqTimes[r.URL.Path]++
-			reqSeconds[r.URL.Path] += timeCost(t)
-		}(time.Now())
+type authRuleList []authRule
 
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			handler.ServeHTTP(w, r)
-			return
+func (l *authRuleList) String() string {
+	var rules []string
+	for _, rule := range *l {
+		mode := "optional"
+		if rule.Required {
+			mode = "required"
 		}
-		w.Header().Set("Content-Encoding", "gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-		gzw := gzipResponseWriter{Writer: gz, ResponseWriter: w}
-		handler.ServeHTTP(gzw, r)
-	})
+		rules = append(rules, rule.Prefix+"="+mode)
+	}
+	return strings.Join(rules, ",")
 }
 
-func GetLocalIP() string {
-	if addrs, err := net.InterfaceAddrs(); err == nil {
-		for _, address := range addrs {
-			// check the address type and if it is not a loopback the display it
-			if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
-				return ipnet.IP.String()
+func (l *authRuleList) Set(s string) error {
+	prefix, mode, _ := strings.Cut(s, "=")
+	if mode != "required" && mode != "optional" {
+		return fmt.Errorf("invalid auth rule %q: must be /prefix=required or /prefix=optional", s)
+	}
+	*l = append(*l, authRule{path.Clean("/" + prefix), mode == "required"})
+	return nil
+}
+
+// the rule with the longest prefix matching upath on a segment boundary
+func (l authRuleList) match(upath string) (authRule, bool) {
+	var best authRule
+	found := false
+	for _, rule := range l {
+		if rule.Prefix == "/" || upath == rule.Prefix || strings.HasPrefix(upath, rule.Prefix+"/") {
+			if !found || len(rule.Prefix) > len(best.Prefix) {
+				best, found = rule, true
 			}
 		}
 	}
-	return "127.0.0.1"
+	return best, found
 }
 
-func timeCost(start time.Time) float64 {
-	return time.Since(start).Seconds()
+type Entry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Dup     bool      `json:"dup,omitempty"` // differs from another entry only by case
 }
 
-// delete file
-// curl -X POST -d "filepath=bar/sample.pdf" http://127.0.0.1:2333/delete
-func delete(w http.ResponseWriter, r *http.Request) {
-	defer func(t time.Time) {
-		reqTimes[r.URL.Path]++
-		reqSeconds[r.URL.Path] += timeCost(t)
-	}(time.Now())
+// central route registry, every route is served at /path and /path/
+type Route struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+	Desc    string   `json:"description"`
+	handler http.Handler
+}
 
-	if r.Method == "POST" {
-		r.ParseForm()
-		fpath := strings.TrimSpace(r.FormValue("filepath"))
-		if fpath == "" {
-			log.Println("Delete file error: no file specified")
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, "✘ Failed: no file specified")
-			return
-		}
+var routes []Route
 
-		// fmt.Println(dir, fpath, handler.Filename)
-		fullpath := filepath.Join(dir, fpath)
+type Server struct {
+	Protocol string
+	Host     string
+	Port     string
+	Prefix   string // path prefix of a reverse proxy, X-Forwarded-Prefix
+	Name     string
+	Rand     *lockedRand // source of the random endpoints, seeded by -seed
+}
 
-		if err := os.RemoveAll(fullpath); err != nil {
-			log.Println("Delete file error: ", err.Error())
-			fmt.Fprintf(w, "✘ Failed: %s", err.Error())
-			return
-		}
+// math/rand source safe for concurrent use, a fixed -seed makes
+// /uuid, /randint and /randstr reproducible
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
 
-		log.Println("Delete file", fpath, "successfully")
-		fmt.Fprintf(w, "✔ Succeeded")
-	} else {
-		log.Println("Delete file error: requst method must be post")
-		fmt.Fprintf(w, "✘ Failed: requst method must be post")
-	}
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
 }
 
-// upload file
-// curl -X POST -F "path=test" -F "file=@/home/xshrim/a.js" http://127.0.0.1:2333/upload
-// curl -X POST -F "file=@/home/xshrim/a.js" http://127.0.0.1:2333/upload/test/a.js
-func upload(w http.ResponseWriter, r *http.Request) {
-	defer func(t time.Time) {
-		reqTimes[r.URL.Path]++
-		reqSeconds[r.URL.Path] += timeCost(t)
-	}(time.Now())
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
+}
+
+func (l *lockedRand) Int63n(n int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Int63n(n)
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
 
-	pl := "http"
+func (l *lockedRand) Read(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Read(b)
+}
+
+var seed int64
+
+// source of -chaos and the gofs_random metric, apart from the random endpoints
+// so their draws do not disturb a fixed -seed sequence
+var random = newLockedRand(time.Now().UnixNano())
+
+// source of the random endpoints handed to the Server, seeded by -seed
+var seededRand = newLockedRand(time.Now().UnixNano())
+
+// the externally visible protocol, host and port, overridable by the
+// WEBPROTOCOL, WEBHOST and WEBPORT environment variables
+func serverInfo() *Server {
+	pl := protocol
 	ht := host
 	pt := port
 
@@ -199,351 +387,4467 @@ func upload(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if r.Method == "GET" {
-		// crutime := time.Now().Unix()
-		// h := md5.New()
-		// io.WriteString(h, strconv.FormatInt(crutime, 10))
-		// token := fmt.Sprintf("%x", h.Sum(nil))
-		// t, _ := template.ParseFiles("front.html")
-
-		t, _ := template.New("index").Parse(html)
-
-		// t.Execute(w, token)
-		t.Execute(w, &Server{
-			Protocol: pl,
-			Host:     ht,
-			Port:     pt,
-		})
-		return
+	return &Server{
+		Protocol: pl,
+		Host:     ht,
+		Port:     pt,
+		Name:     serverName,
+		Rand:     seededRand,
 	}
+}
 
-	r.ParseMultipartForm(maxUploadSize)
-
-	fpath := strings.TrimSpace(r.FormValue("path"))
+// the externally visible address for this request, the X-Forwarded-Proto, -Host,
+// -Port and -Prefix headers are honored when the peer is a -trustproxy proxy
+func requestServer(r *http.Request) *Server {
+	srv := serverInfo()
 
-	file, handler, err := r.FormFile("file")
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.Println("Receive file error: ", err.Error())
-		// w.WriteHeader(http.StatusNoContent)
-		fmt.Fprintf(w, "✘ Failed: "+err.Error())
-		return
+		peer = r.RemoteAddr
 	}
-	defer file.Close()
-
-	log.Println(fmt.Sprintf("Receiving file [filename: %+v, filesize: %+vB, httpheader: %+v", handler.Filename, handler.Size, handler.Header))
-
-	fileBytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		log.Println("Receive file error: ", err.Error())
-		w.WriteHeader(http.StatusNoContent)
-		fmt.Fprintf(w, "✘ Failed: "+err.Error())
-		return
+	if ip := net.ParseIP(peer); ip == nil || !trusted(ip) {
+		return srv
 	}
 
-	// tempFile, err := ioutil.TempFile(filePath, handler.Filename)
-	if fpath == "" {
-		fpath = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload"), handler.Filename)
+	// the first value is the one the client-facing proxy set
+	first := func(name string) string {
+		v, _, _ := strings.Cut(r.Header.Get(name), ",")
+		return strings.TrimSpace(v)
+	}
+	if proto := strings.ToLower(first("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+		srv.Protocol = proto
+		srv.Port = map[string]string{"http": "80", "https": "443"}[proto]
+	}
+	if fh := first("X-Forwarded-Host"); fh != "" {
+		if h, p, err := net.SplitHostPort(fh); err == nil {
+			if _, err := strconv.Atoi(p); err == nil {
+				srv.Host, srv.Port = h, p
+			}
+		} else {
+			srv.Host = fh
+		}
+	}
+	if fp := first("X-Forwarded-Port"); fp != "" {
+		if _, err := strconv.Atoi(fp); err == nil {
+			srv.Port = fp
+		}
+	}
+	if prefix := strings.TrimSuffix(first("X-Forwarded-Prefix"), "/"); prefix != "" {
+		srv.Prefix = path.Clean("/" + prefix)
 	}
+	return srv
+}
 
-	// fmt.Println(dir, fpath, handler.Filename)
-	fullpath := filepath.Join(dir, fpath, handler.Filename)
+// the full url of the slash separated path
+func (s *Server) URL(upath string) string {
+	return fmt.Sprintf("%s://%s:%s%s", s.Protocol, s.Host, s.Port, (&url.URL{Path: s.Prefix + upath}).EscapedPath())
+}
 
-	os.MkdirAll(filepath.Dir(fullpath), os.ModePerm)
+// the url a client should fetch the path from
+// curl http://127.0.0.1:2333/url/bar/sample.pdf
+func urlOf(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
 
-	if err := ioutil.WriteFile(fullpath, fileBytes, os.ModePerm); err != nil {
-		log.Println("Create file error: ", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "✘ Failed: "+err.Error())
+	upath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/url"))
+	link := requestServer(r).URL(upath)
+	if wantJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"path": upath, "url": link})
 		return
 	}
+	writeText(w, link)
+}
 
-	log.Println("Receive file successfully")
-
-	fmt.Fprintf(w, "✔ Succeeded")
+// Gzip Compression
+type gzipResponseWriter struct {
+	io.Writer
+	http.ResponseWriter
+}
 
+func (w gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.Writer.Write(b)
 }
 
-func delay(w http.ResponseWriter, r *http.Request) {
-	defer func(t time.Time) {
-		reqTimes[r.URL.Path]++
-		reqSeconds[r.URL.Path] += timeCost(t)
-	}(time.Now())
+// the encoding applied to everything written, error bodies included
+func (w gzipResponseWriter) Encoding() string {
+	return "gzip"
+}
 
-	delay := strings.TrimPrefix(r.URL.Path, "/delay/")
-	if r.URL.Path == "/delay" {
-		delay = ""
+// push the compressed bytes so far to the client, for streamed responses
+func (w gzipResponseWriter) Flush() {
+	if gz, ok := w.Writer.(*gzip.Writer); ok {
+		gz.Flush()
 	}
-
-	if delay != "" {
-		var err error
-		sec, err := strconv.Atoi(delay)
-		dur := time.Duration(sec) * time.Second
-		if err != nil {
-			dur, err = time.ParseDuration(delay)
-			if err != nil {
-				return
-			}
-		}
-		time.Sleep(dur)
-		fmt.Fprintf(w, "(%s later) ", dur)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
+}
 
-	fmt.Fprintf(w, "[Headers]:\n")
+func Gzip(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer record(r.URL.Path, time.Now())
 
-	for name, headers := range r.Header {
-		for _, h := range headers {
-			fmt.Fprintf(w, "%v: %v\n", name, h)
+		// HEAD answers with the real Content-Length, so clients can check
+		// the size of an existing file before (re)uploading it
+		if r.Method == "HEAD" || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			handler.ServeHTTP(w, r)
+			return
 		}
-	}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		gz, _ := gzip.NewWriterLevel(w, gzipLevel) // level is validated at startup
+		defer gz.Close()
+		gzw := gzipResponseWriter{Writer: gz, ResponseWriter: w}
+		handler.ServeHTTP(gzw, r)
+	})
 }
 
-func echo(w http.ResponseWriter, r *http.Request) {
-	defer func(t time.Time) {
-		reqTimes[r.URL.Path]++
-		reqSeconds[r.URL.Path] += timeCost(t)
-	}(time.Now())
-
-	reg := regexp.MustCompile(`/echo/?(\d*)/?([^/]*)/?(\S*)`) // 中文括号，例如：华南地区（广州） -> 广州
-	matches := reg.FindStringSubmatch(r.URL.Path)
-	scode := matches[1]
-	headers := matches[2]
-	content := matches[3]
-
-	for _, header := range strings.Split(headers, ",") {
-		header = strings.TrimSpace(header)
-		if header == "" {
-			continue
-		}
-		kv := strings.Split(header, "=")
-		name := strings.TrimSpace(kv[0])
-		value := strings.TrimSpace(kv[1])
-		w.Header().Add(name, value)
-	}
+// status recorder for the logger
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
 
-	code, err := strconv.Atoi(scode)
-	if err != nil {
-		code = 200
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
 	}
+	w.ResponseWriter.WriteHeader(code)
+}
 
-	w.WriteHeader(code)
-
-	fmt.Fprintf(w, ">>> %s %s %s\n", r.Method, r.URL, r.Proto)
-	fmt.Fprintf(w, ">>> Host: %s\n", r.Host)
-	for name, headers := range r.Header {
-		for _, h := range headers {
-			fmt.Fprintf(w, ">>> %v: %v\n", name, h)
-		}
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
 	}
-	fmt.Fprintf(w, "\n")
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
 
-	fmt.Fprintf(w, "<<< %s %d %s\n", r.Proto, code, http.StatusText(code))
-	for name, headers := range w.Header() {
-		for _, h := range headers {
-			fmt.Fprintf(w, "<<< %v: %v\n", name, h)
-		}
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
-
-	fmt.Fprintf(w, "\n%s\n", content)
 }
 
-func ip(w http.ResponseWriter, r *http.Request) {
-	defer func(t time.Time) {
-		reqTimes[r.URL.Path]++
-		reqSeconds[r.URL.Path] += timeCost(t)
-	}(time.Now())
+var secure bool
+var cspPolicy string
 
-	fmt.Fprintf(w, GetLocalIP())
+// Security Headers (-secure)
+func Secure(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if secure {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+			w.Header().Set("Referrer-Policy", "same-origin")
+			if cspPolicy != "" {
+				w.Header().Set("Content-Security-Policy", cspPolicy)
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
 }
 
-func uuid(w http.ResponseWriter, r *http.Request) {
-	defer func(t time.Time) {
-		reqTimes[r.URL.Path]++
-		reqSeconds[r.URL.Path] += timeCost(t)
-	}(time.Now())
-
-	b := make([]byte, 16)
-	_, err := rand.Read(b)
-	if err != nil {
-		fmt.Fprintf(w, err.Error())
+// the upload form posts into an iframe at the advertised address, which may be
+// another origin than the page was opened from, so the -csp is widened for it,
+// directives already in -csp take precedence
+func relaxCSP(w http.ResponseWriter, srv *Server) {
+	if !secure || cspPolicy == "" {
 		return
 	}
+	origin := strings.TrimSuffix(srv.URL("/"), "/")
+	w.Header().Del("X-Frame-Options")
+	w.Header().Set("Content-Security-Policy", fmt.Sprintf("%s; form-action 'self' %s; frame-src 'self' %s; frame-ancestors 'self' %s", cspPolicy, origin, origin, origin))
+}
 
-	fmt.Fprintf(w, fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+// Server Header
+func Branding(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", serverName)
+		handler.ServeHTTP(w, r)
+	})
 }
 
-func randint(w http.ResponseWriter, r *http.Request) {
-	defer func(t time.Time) {
-		reqTimes[r.URL.Path]++
-		reqSeconds[r.URL.Path] += timeCost(t)
-	}(time.Now())
+var foldCase bool
 
-	maxstr := strings.TrimPrefix(r.URL.Path, "/randint/")
-	if r.URL.Path == "/randint" {
-		maxstr = ""
+// canonical form of a request path: cleaned like path.Clean but keeping the trailing slash,
+// and with -foldcase the utility route prefix lowercased, file paths keep their case
+func normalizePath(p string) string {
+	clean := path.Clean("/" + p)
+	if clean != "/" && (strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/.")) {
+		clean += "/"
 	}
-
-	max, err := strconv.Atoi(maxstr)
-	if err != nil {
-		// fmt.Fprintf(w, err.Error())
-		// return
-		max = 100
+	if !foldCase {
+		return clean
 	}
 
-	fmt.Fprintf(w, fmt.Sprintf("%d", rand.Intn(max)))
+	best := ""
+	for _, route := range routes {
+		n := len(route.Path)
+		if route.Path == "/" || len(clean) < n || !strings.EqualFold(clean[:n], route.Path) {
+			continue
+		}
+		if (len(clean) == n || clean[n] == '/') && n > len(best) {
+			best = route.Path
+		}
+	}
+	if best != "" {
+		clean = best + clean[len(best):]
+	}
+	return clean
 }
 
-func randstr(w http.ResponseWriter, r *http.Request) {
-	defer func(t time.Time) {
-		reqTimes[r.URL.Path]++
-		reqSeconds[r.URL.Path] += timeCost(t)
-	}(time.Now())
+// Path Normalization
+// //echo, /echo/../ip and /echo/. are served as /echo, /ip and /echo/, GET and HEAD are redirected
+// to the canonical path, other methods are rewritten so their bodies are not lost to a redirect
+// curl -X POST http://127.0.0.1:2333//echo/201
+func Normalize(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		canonical := normalizePath(r.URL.Path)
+		if canonical == r.URL.Path {
+			handler.ServeHTTP(w, r)
+			return
+		}
 
-	lengthstr := strings.TrimPrefix(r.URL.Path, "/randstr/")
-	if r.URL.Path == "/randstr" {
-		lengthstr = ""
-	}
+		if r.Method == "GET" || r.Method == "HEAD" {
+			target := (&url.URL{Path: canonical}).EscapedPath()
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
 
-	length, err := strconv.Atoi(lengthstr)
-	if err != nil {
-		// fmt.Fprintf(w, err.Error())
-		// return
-		length = 12
-	}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = canonical
+		r2.URL.RawPath = ""
+		handler.ServeHTTP(w, r2)
+	})
+}
 
-	letters := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890+=-_@#~,.[]()!%^*$"
+var logFormat string
+var slowLog time.Duration
+var chaosDelay string
+var chaosMin, chaosMax time.Duration
+var chaosError float64
 
-	var lr = []rune(letters)
-	if length == 0 {
-		length = rand.Intn(100) + 1
+// parse -chaosdelay, a fixed duration like 200ms or a range like 100ms-1s
+func parseChaosDelay(s string) (time.Duration, time.Duration, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	min, err := time.ParseDuration(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, err
 	}
+	max := min
+	if isRange {
+		if max, err = time.ParseDuration(strings.TrimSpace(hi)); err != nil {
+			return 0, 0, err
+		}
+	}
+	if min < 0 || max < min {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	return min, max, nil
+}
+
+// Chaos Injection
+// delay every request by -chaosdelay and fail -chaoserror of them with 503
+func Chaos(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chaosMax > 0 {
+			time.Sleep(chaosMin + time.Duration(random.Int63n(int64(chaosMax-chaosMin)+1)))
+		}
+		if chaosError > 0 && random.Float64() < chaosError {
+			writeError(w, r, http.StatusServiceUnavailable, "injected chaos error")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+var trustProxy string
+var trustedProxies []*net.IPNet
+
+// parse the comma separated -trustproxy CIDRs, a bare ip is a single host
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func trusted(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// the client address, when the peer is a -trustproxy proxy it is the right-most
+// X-Forwarded-For entry that is not a trusted proxy, so clients cannot spoof it
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !trusted(ip) {
+		return host
+	}
+
+	var hops []string
+	for _, xff := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(xff, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// garbage in the chain, nothing left of it can be trusted
+			return host
+		}
+		host = ip.String()
+		if !trusted(ip) {
+			return host
+		}
+	}
+	return host
+}
+
+// Request Logger
+// 5xx are logged as ERROR, 4xx as WARN and the others as INFO
+func Logger(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status == http.StatusNotFound && quiet404 {
+			return
+		}
+		// with -slowlog only the requests taking longer are logged
+		if slowLog > 0 && elapsed < slowLog {
+			return
+		}
+		// only 1 in -logsample successful requests is logged, errors always are
+		if slowLog <= 0 && status < 400 && logSample > 1 && atomic.AddUint64(&logCounter, 1)%uint64(logSample) != 0 {
+			return
+		}
+
+		level := "INFO"
+		if status >= 500 {
+			level = "ERROR"
+		} else if status >= 400 {
+			level = "WARN"
+		}
+
+		remote := r.RemoteAddr
+		if len(trustedProxies) > 0 {
+			remote = clientIP(r)
+		}
+
+		switch logFormat {
+		case "json":
+			line, _ := json.Marshal(map[string]interface{}{
+				"time":       start.Format(time.RFC3339),
+				"level":      level,
+				"remote":     remote,
+				"method":     r.Method,
+				"uri":        r.URL.RequestURI(),
+				"proto":      r.Proto,
+				"status":     status,
+				"bytes":      rec.size,
+				"duration":   elapsed.Seconds(),
+				"referer":    r.Referer(),
+				"user_agent": r.UserAgent(),
+			})
+			fmt.Fprintln(accessLog(), string(line))
+		case "combined":
+			fmt.Fprintln(accessLog(), combinedLine(r, start, status, rec.size))
+		default:
+			log.Println(fmt.Sprintf("[%s] %s %s %s %d %dB %s", level, remote, r.Method, r.URL.RequestURI(), status, rec.size, elapsed))
+		}
+	})
+}
+
+var logBuffer int
+var logFlush time.Duration
+var logSink *bufferedSink
+
+// stdout batching access log lines in a bounded buffer (-logbuffer), it is
+// written out when full, every -logflush and on shutdown
+type bufferedSink struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func (s *bufferedSink) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(b)
+}
+
+func (s *bufferedSink) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		log.Println("Flush access log error: ", err.Error())
+	}
+}
+
+// where the json and combined access lines go
+func accessLog() io.Writer {
+	if logSink != nil {
+		return logSink
+	}
+	return log.Writer()
+}
+
+// apache/nginx combined log format
+// %h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"
+func combinedLine(r *http.Request, start time.Time, status int, size int64) string {
+	host := clientIP(r)
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = quoteLog(u)
+	}
+	sent := "-"
+	if size > 0 {
+		sent = strconv.FormatInt(size, 10)
+	}
+	referer, agent := "-", "-"
+	if r.Referer() != "" {
+		referer = quoteLog(r.Referer())
+	}
+	if r.UserAgent() != "" {
+		agent = quoteLog(r.UserAgent())
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s "%s" "%s"`,
+		host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, quoteLog(r.URL.RequestURI()), r.Proto, status, sent, referer, agent)
+}
+
+// escape quotes, backslashes and control characters the way apache does
+func quoteLog(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// writer discarding everything beyond n bytes
+type cappedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *cappedWriter) Write(b []byte) (int, error) {
+	if c.n > 0 {
+		p := b
+		if int64(len(p)) > c.n {
+			p = p[:c.n]
+		}
+		n, err := c.w.Write(p)
+		c.n -= int64(n)
+		if err != nil {
+			c.n = 0
+		}
+	}
+	return len(b), nil
+}
+
+// credential bearing headers kept out of the record files
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Idempotency-Key"}
+
+// Request Recorder
+// dump each request into a timestamped file under -record for debugging,
+// the body is teed into the file while the handler reads it
+func Recorder(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if recordDir == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		name := fmt.Sprintf("%s-%06d.txt", time.Now().Format("20060102T150405.000000000"), atomic.AddUint64(&recordCounter, 1))
+		f, err := os.Create(filepath.Join(recordDir, name))
+		if err != nil {
+			log.Println("Record request error: ", err.Error())
+			handler.ServeHTTP(w, r)
+			return
+		}
+		defer f.Close()
+
+		header := r.Header.Clone()
+		for _, key := range redactedHeaders {
+			if header.Get(key) != "" {
+				header.Set(key, "[redacted]")
+			}
+		}
+		fmt.Fprintf(f, "%s %s %s\r\n", r.Method, r.URL.RequestURI(), r.Proto)
+		fmt.Fprintf(f, "Host: %s\r\n", r.Host)
+		header.Write(f)
+		fmt.Fprintf(f, "\r\n")
+
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, &cappedWriter{w: f, n: recordMax}), r.Body}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// check the basic auth credentials of the request against user:pass
+func checkAuth(r *http.Request, cred string) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	u, p, _ := strings.Cut(cred, ":")
+	return subtle.ConstantTimeCompare([]byte(user), []byte(u)) == 1 && subtle.ConstantTimeCompare([]byte(pass), []byte(p)) == 1
+}
+
+// Basic Auth
+// /metrics is protected by -metricsauth when set, otherwise it inherits -auth
+// -authrule prefixes marked optional are served without a challenge, they never
+// override -metricsauth and never open up /metrics/reset
+func Auth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred := authCred
+		upath := path.Clean("/" + r.URL.Path)
+		if (upath == "/metrics" || strings.HasPrefix(upath, "/metrics/")) && metricsAuth != "" {
+			cred = metricsAuth
+		} else if rule, ok := authRules.match(upath); ok && !rule.Required && upath != "/metrics/reset" {
+			cred = ""
+		}
+
+		if cred != "" && !checkAuth(r, cred) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gofs"`)
+			writeError(w, r, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Pre-compressed Sidecars
+// serve path.br or path.gz instead of compressing on the fly when the client accepts it
+func Precompressed(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !(precompressed || compressStore) || r.Method != "GET" && r.Method != "HEAD" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		upath := path.Clean("/" + r.URL.Path)
+		fullpath := filepath.Join(servedDir(), filepath.FromSlash(upath))
+		// the name.gz of an upload stored by -compressstore is the file name
+		if compressStore && stored(w, r, upath, fullpath) {
+			return
+		}
+		fi, err := os.Stat(fullpath)
+		if !precompressed || err != nil || fi.IsDir() {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		accept := r.Header.Get("Accept-Encoding")
+		for _, enc := range []struct{ ext, name string }{{".br", "br"}, {".gz", "gzip"}} {
+			if !strings.Contains(accept, enc.name) {
+				continue
+			}
+			f, err := os.Open(fullpath + enc.ext)
+			if err != nil {
+				continue
+			}
+			defer f.Close()
+			fi, err := f.Stat()
+			if err != nil || fi.IsDir() {
+				continue
+			}
+
+			defer record(r.URL.Path, time.Now())
+			if r.Method == "GET" {
+				countDownload(fullpath)
+				defer observeTransfer("download", time.Now())
+			}
+			w.Header().Set("Content-Type", fileType(w, fullpath, fullpath, false))
+			w.Header().Set("Content-Encoding", enc.name)
+			w.Header().Add("Vary", "Accept-Encoding")
+			http.ServeContent(w, r, upath, fi.ModTime(), f)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// content type by the extension of name, extensionless files are sniffed from
+// the first 512 bytes of src, sniffed html is downgraded to text/plain and
+// nosniff is set so an uploaded file cannot run scripts on this origin
+func fileType(w http.ResponseWriter, name string, src string, gzipped bool) string {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	f, err := os.Open(src)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	var rd io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return "application/octet-stream"
+		}
+		defer gz.Close()
+		rd = gz
+	}
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(rd, head)
+	ctype := http.DetectContentType(head[:n])
+	if strings.HasPrefix(ctype, "text/html") || strings.HasPrefix(ctype, "text/xml") {
+		ctype = "text/plain; charset=utf-8"
+	}
+	return ctype
+}
+
+// serve name from the name.gz stored by -compressstore, as is to clients
+// accepting gzip and decompressed for the others
+func stored(w http.ResponseWriter, r *http.Request, upath string, fullpath string) bool {
+	f, err := os.Open(fullpath + ".gz")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return false
+	}
+
+	defer record(r.URL.Path, time.Now())
+	if r.Method == "GET" {
+		countDownload(fullpath)
+		defer observeTransfer("download", time.Now())
+	}
+
+	w.Header().Set("Content-Type", fileType(w, fullpath, fullpath+".gz", true))
+	w.Header().Set("ETag", fileETag(fi))
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		http.ServeContent(w, r, upath, fi.ModTime(), f)
+		return true
+	}
+
+	// HEAD and range requests need the decompressed size, which costs an extra pass
+	if r.Method == "HEAD" || r.Header.Get("Range") != "" {
+		content, err := newGzipSeeker(f)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return true
+		}
+		http.ServeContent(w, r, upath, fi.ModTime(), content)
+		return true
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return true
+	}
+	defer gz.Close()
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	io.Copy(w, gz)
+	return true
+}
+
+// the name.gz stored by -compressstore for fullpath when there is one, otherwise fullpath
+func storedPath(fullpath string) string {
+	if compressStore {
+		if fi, err := os.Stat(fullpath + ".gz"); err == nil && fi.Mode().IsRegular() {
+			return fullpath + ".gz"
+		}
+	}
+	return fullpath
+}
+
+// the content of fullpath as it is served, read from the -compressstore name.gz when stored so
+func readStored(fullpath string) (string, error) {
+	stored := storedPath(fullpath)
+	f, err := os.Open(stored)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var content io.Reader = f
+	if stored != fullpath {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		content = gz
+	}
+	data, err := io.ReadAll(content)
+	return string(data), err
+}
+
+// the name a directory entry is served as, -compressstore serves name.gz as name
+func servedName(de os.DirEntry) string {
+	if compressStore && !de.IsDir() && strings.HasSuffix(de.Name(), ".gz") {
+		return strings.TrimSuffix(de.Name(), ".gz")
+	}
+	return de.Name()
+}
+
+// seekable view of the decompressed content of a stored file for http.ServeContent,
+// seeking only moves the position, reads catch up by decompressing and a backward
+// seek starts over
+type gzipSeeker struct {
+	f    *os.File
+	gz   *gzip.Reader
+	pos  int64 // decompressed position of gz
+	off  int64 // position asked for by Seek
+	size int64
+}
+
+func newGzipSeeker(f *os.File) (*gzipSeeker, error) {
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(io.Discard, gz)
+	if err != nil {
+		return nil, err
+	}
+	s := &gzipSeeker{f: f, gz: gz, size: size}
+	return s, s.rewind()
+}
+
+func (s *gzipSeeker) rewind() error {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.pos = 0
+	return s.gz.Reset(s.f)
+}
+
+func (s *gzipSeeker) Read(p []byte) (int, error) {
+	if s.off < s.pos {
+		if err := s.rewind(); err != nil {
+			return 0, err
+		}
+	}
+	if s.off > s.pos {
+		n, err := io.CopyN(io.Discard, s.gz, s.off-s.pos)
+		s.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.gz.Read(p)
+	s.pos += int64(n)
+	s.off = s.pos
+	return n, err
+}
+
+func (s *gzipSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.off
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative position %d", offset)
+	}
+	s.off = offset
+	return offset, nil
+}
+
+// the ?ext=pdf,txt and ?type=dir|file filter of a listing
+// invalid filters are ignored, the ext filter only applies to files
+func entryFilter(query url.Values) func(de os.DirEntry) bool {
+	exts := make(map[string]bool)
+	for _, ext := range strings.Split(query.Get("ext"), ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			exts[ext] = true
+		}
+	}
+	typ := strings.ToLower(query.Get("type"))
+
+	return func(de os.DirEntry) bool {
+		if typ == "dir" && !de.IsDir() || typ == "file" && de.IsDir() {
+			return false
+		}
+		return len(exts) == 0 || de.IsDir() || exts[strings.ToLower(strings.TrimPrefix(filepath.Ext(servedName(de)), "."))]
+	}
+}
+
+// read directory entries, filtered by entryFilter
+func readEntries(fullpath string, upath string, query url.Values) ([]Entry, error) {
+	des, err := os.ReadDir(fullpath)
+	if err != nil {
+		return nil, err
+	}
+
+	keep := entryFilter(query)
+
+	// names differing only by case clash on case-insensitive filesystems
+	folded := make(map[string]int)
+	for _, de := range des {
+		folded[strings.ToLower(servedName(de))]++
+	}
+	dups := 0
+	for _, n := range folded {
+		if n > 1 {
+			dups += n
+		}
+	}
+	label := path.Clean(upath)
+	metricsMu.Lock()
+	if dups > 0 {
+		dupNames[label] = dups
+	} else {
+		delete(dupNames, label)
+	}
+	metricsMu.Unlock()
+
+	var entries []Entry
+	for _, de := range des {
+		if !keep(de) {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		name := servedName(de)
+		entries = append(entries, Entry{Name: name, IsDir: de.IsDir(), Size: fi.Size(), ModTime: fi.ModTime(), Dup: folded[strings.ToLower(name)] > 1})
+	}
+
+	return entries, nil
+}
+
+// one json entry per line, read and flushed in batches so huge directories
+// are never held in memory, the case clash detection needs all names and is skipped
+func streamEntries(w http.ResponseWriter, r *http.Request, fullpath string) {
+	f, err := os.Open(fullpath)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer f.Close()
+
+	keep := entryFilter(r.URL.Query())
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for {
+		des, err := f.ReadDir(256)
+		for _, de := range des {
+			if !keep(de) {
+				continue
+			}
+			fi, err := de.Info()
+			if err != nil {
+				continue
+			}
+			enc.Encode(Entry{Name: servedName(de), IsDir: de.IsDir(), Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+		if fl, ok := w.(http.Flusher); ok {
+			fl.Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Read directory error: ", err.Error())
+			}
+			return
+		}
+	}
+}
+
+// json index of the directory
+func writeIndex(w http.ResponseWriter, upath string, entries []Entry) {
+	if entries == nil {
+		entries = []Entry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":    upath,
+		"entries": entries,
+	})
+}
+
+// directory listing
+// curl -X GET "http://127.0.0.1:2333/bar/?ext=pdf,txt&type=file"
+// curl -X GET "http://127.0.0.1:2333/bar/?format=ndjson"
+// curl -X GET -H "Accept: application/json" http://127.0.0.1:2333/bar/
+func listing(w http.ResponseWriter, r *http.Request, fullpath string) {
+	if r.URL.Query().Get("format") == "ndjson" {
+		streamEntries(w, r, fullpath)
+		return
+	}
+
+	upath := path.Clean("/" + r.URL.Path)
+	entries, err := readEntries(fullpath, upath, r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if upath != "/" {
+		upath += "/"
+	}
+
+	if wantJSON(r) {
+		writeIndex(w, upath, entries)
+		return
+	}
+
+	// without the trailing slash (-noslashredirect) the links need the directory name,
+	// url.URL escapes a name like javascript:x as ./javascript:x so it stays a path
+	prefix := ""
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		prefix = (&url.URL{Path: path.Base(r.URL.Path)}).String() + "/"
+	}
+
+	// the filters are kept while browsing, the page is not
+	values := r.URL.Query()
+	values.Del("page")
+	query := ""
+	if len(values) > 0 {
+		query = "?" + values.Encode()
+	}
+
+	// server side paging (-pagesize), so huge directories stay responsive
+	page, pages := 1, 1
+	if pageSize > 0 && len(entries) > pageSize {
+		pages = (len(entries) + pageSize - 1) / pageSize
+		if n, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && n > 0 {
+			page = n
+		}
+		if page > pages {
+			page = pages
+		}
+		end := page * pageSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		entries = entries[(page-1)*pageSize : end]
+	}
+	pageLink := func(n int) string {
+		if n < 1 || n > pages {
+			return ""
+		}
+		values.Set("page", strconv.Itoa(n))
+		return prefix + "?" + values.Encode()
+	}
+
+	type row struct {
+		Entry
+		Link string
+		Warn bool
+	}
+	rows := make([]row, 0, len(entries))
+	for _, e := range entries {
+		link := prefix + (&url.URL{Path: e.Name}).String()
+		if e.IsDir {
+			e.Name += "/"
+			link += "/" + query // keep the filters while browsing
+		}
+		rows = append(rows, row{Entry: e, Link: link, Warn: e.Dup && dupWarn})
+	}
+
+	parent := ""
+	if upath != "/" {
+		parent = "../"
+		if prefix != "" {
+			parent = "./"
+		}
+	}
+
+	// an empty root greets first-time users with -emptymessage instead of a bare table,
+	// unless the entries are only hidden by the filters
+	empty := ""
+	if upath == "/" && len(entries) == 0 && len(r.URL.Query()) == 0 {
+		empty = emptyMessage
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t, _ := template.New("listing").Parse(listingHTML)
+	t.Execute(w, map[string]interface{}{
+		"Empty":  empty,
+		"Upload": !readOnly,
+		"Readme": renderReadme(fullpath),
+		"Motd":   getMotd(),
+		"Name":   serverName,
+		"Path":   upath,
+		"Parent": parent,
+		"Rows":   rows,
+		"Page":   page,
+		"Pages":  pages,
+		"Prev":   pageLink(page - 1),
+		"Next":   pageLink(page + 1),
+	})
+}
+
+const maxReadmeSize = 1 << 20
+
+// README.md of the directory rendered to html (-readme), raw html in the
+// markdown is dropped and dangerous link schemes are filtered by goldmark
+func renderReadme(fullpath string) string {
+	if !readme {
+		return ""
+	}
+	for _, name := range []string{"README.md", "readme.md", "Readme.md"} {
+		f, err := os.Open(filepath.Join(fullpath, name))
+		if err != nil {
+			continue
+		}
+		source, err := io.ReadAll(io.LimitReader(f, maxReadmeSize))
+		f.Close()
+		if err != nil {
+			log.Println("Read readme error: ", err.Error())
+			return ""
+		}
+
+		var buf bytes.Buffer
+		if err := goldmark.Convert(source, &buf); err != nil {
+			log.Println("Render readme error: ", err.Error())
+			return ""
+		}
+		return buf.String()
+	}
+	return ""
+}
+
+// generated index.json (-autoindex), it is served for a missing <dir>/index.json
+// and for directories requested as json without their own index.json
+// curl -X GET http://127.0.0.1:2333/bar/index.json
+func autoindex(w http.ResponseWriter, r *http.Request, upath string, fullpath string) bool {
+	if path.Base(upath) == "index.json" {
+		if _, err := os.Stat(fullpath); !os.IsNotExist(err) {
+			return false
+		}
+		upath, fullpath = path.Dir(upath), filepath.Dir(fullpath)
+	} else if !wantJSON(r) {
+		return false
+	}
+
+	if fi, err := os.Stat(fullpath); err != nil || !fi.IsDir() {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(fullpath, "index.json")); err == nil {
+		http.ServeFile(w, r, filepath.Join(fullpath, "index.json"))
+		return true
+	}
+
+	entries, err := readEntries(fullpath, upath, r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return true
+	}
+	if upath != "/" {
+		upath += "/"
+	}
+	writeIndex(w, upath, entries)
+	return true
+}
+
+// serve files, directories without index.html are listed by ourselves
+func files(w http.ResponseWriter, r *http.Request) {
+	root := servedDir()
+	upath := path.Clean("/" + r.URL.Path)
+	fullpath := filepath.Join(root, filepath.FromSlash(upath))
+
+	if autoIndex && autoindex(w, r, upath, fullpath) {
+		return
+	}
+
+	fi, err := os.Stat(fullpath)
+	if err == nil && fi.Mode().IsRegular() && r.Method == "GET" {
+		countDownload(fullpath)
+		defer observeTransfer("download", time.Now())
+	}
+	if err == nil && fi.Mode().IsRegular() {
+		w.Header().Set("ETag", fileETag(fi))
+	}
+	if err == nil && fi.Mode().IsRegular() && filepath.Ext(fullpath) == "" {
+		w.Header().Set("Content-Type", fileType(w, fullpath, fullpath, false))
+	}
+
+	if err == nil && fi.IsDir() {
+		slash := strings.HasSuffix(r.URL.Path, "/")
+		if slash || noSlashRedirect {
+			index := filepath.Join(fullpath, "index.html")
+			if _, err := os.Stat(index); os.IsNotExist(err) {
+				listing(w, r, fullpath)
+				return
+			}
+			// http.FileServer would redirect to the trailing slash
+			if !slash {
+				http.ServeFile(w, r, index)
+				return
+			}
+		}
+	}
+
+	http.FileServer(http.Dir(root)).ServeHTTP(w, r)
+}
+
+// serve the single -file at / (and at /<name>), there is no directory browsing
+// curl -X GET -OJ "http://127.0.0.1:2333/?download=1"
+func single(w http.ResponseWriter, r *http.Request) {
+	name := filepath.Base(singleFile)
+	if r.URL.Path != "/" && r.URL.Path != "/"+name {
+		http.NotFound(w, r)
+		return
+	}
+
+	disposition := "inline"
+	if r.URL.Query().Get("download") != "" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+
+	if r.Method == "GET" {
+		countDownload(name)
+		defer observeTransfer("download", time.Now())
+	}
+	http.ServeFile(w, r, singleFile)
+}
+
+// keyed mutex, one lock per path
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+var pathLocksMu sync.Mutex
+var pathLocks = make(map[string]*pathLock)
+
+// lock the path and return the unlock function
+func lockPath(p string) func() {
+	pathLocksMu.Lock()
+	l, ok := pathLocks[p]
+	if !ok {
+		l = &pathLock{}
+		pathLocks[p] = l
+	}
+	l.refs++
+	pathLocksMu.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		pathLocksMu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(pathLocks, p)
+		}
+		pathLocksMu.Unlock()
+	}
+}
+
+// let's encrypt certificate manager for the comma separated domains
+func newCertManager(domains string, cache string) *autocert.Manager {
+	var hosts []string
+	for _, domain := range strings.Split(domains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			hosts = append(hosts, domain)
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cache),
+	}
+}
+
+var httpPort string
+var httpRedirect bool
+
+// plain http listener next to tls, redirects to the https url on -port
+// curl -i http://127.0.0.1:8080/upload
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	h := r.Host
+	if hh, _, err := net.SplitHostPort(r.Host); err == nil {
+		h = hh
+	}
+	if strings.Contains(h, ":") {
+		h = "[" + h + "]"
+	}
+	if port != "443" {
+		h += ":" + port
+	}
+	http.Redirect(w, r, "https://"+h+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// handler of the -httpport listener, the redirect to https or the full handler
+// with -httpredirect=false, wrapped to answer the acme challenges of -autocert
+func plainHandler(handler http.Handler, m *autocert.Manager) http.Handler {
+	plain := handler
+	if httpRedirect {
+		plain = Logger(Branding(http.HandlerFunc(redirectHTTPS)))
+	}
+	if m != nil {
+		plain = m.HTTPHandler(plain)
+	}
+	return plain
+}
+
+var certFile, keyFile string
+var minTLS string
+var minTLSVersion uint16 = tls.VersionTLS12
+
+// forward secret AEAD suites for tls 1.2, tls 1.3 suites are not configurable
+var cipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// apply -mintls and the curated cipher suites
+func secureTLS(cfg *tls.Config) *tls.Config {
+	cfg.MinVersion = minTLSVersion
+	cfg.CipherSuites = cipherSuites
+	return cfg
+}
+
+func GetLocalIP() string {
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, address := range addrs {
+			// check the address type and if it is not a loopback the display it
+			if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				return ipnet.IP.String()
+			}
+		}
+	}
+	return "127.0.0.1"
+}
+
+func timeCost(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// lower case extension without the dot, none for files without one
+func extLabel(name string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	if ext == "" {
+		return "none"
+	}
+	return ext
+}
+
+const maxExtLabel = 16
+
+// the ext label of a download, long or unusual extensions are bucketed as other
+// so odd file names cannot break the metrics text or blow up the series count
+func downloadExt(name string) string {
+	ext := extLabel(name)
+	if len(ext) > maxExtLabel || strings.Trim(ext, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+		return "other"
+	}
+	return ext
+}
+
+var readOnly bool
+var uploadDir string
+var allowExt, denyExt string
+var allowExts, denyExts map[string]bool
+
+// comma separated extensions, "none" stands for names without one
+func parseExts(list string) map[string]bool {
+	exts := make(map[string]bool)
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			exts[ext] = true
+		}
+	}
+	return exts
+}
+
+// whether -allowext/-denyext let a file with this name be uploaded
+func uploadAllowed(name string) bool {
+	ext := extLabel(name)
+	if len(allowExts) > 0 && !allowExts[ext] {
+		return false
+	}
+	return !denyExts[ext]
+}
+
+// count a served file download by its extension
+func countDownload(name string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	downloads[downloadExt(name)]++
+}
+
+// upper bounds in seconds of the transfer duration buckets
+var transferBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// cumulative prometheus histogram, Counts[i] holds the observations <= transferBuckets[i]
+type histogram struct {
+	Counts []uint64 `json:"counts"`
+	Sum    float64  `json:"sum"`
+	Count  uint64   `json:"count"`
+}
+
+var transfers = make(map[string]*histogram)
+
+// record the duration of an upload or download, apart from the per path request seconds
+func observeTransfer(op string, start time.Time) {
+	cost := timeCost(start)
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	h := transfers[op]
+	if h == nil {
+		h = &histogram{Counts: make([]uint64, len(transferBuckets))}
+		transfers[op] = h
+	}
+	for i, le := range transferBuckets {
+		if cost <= le {
+			h.Counts[i]++
+		}
+	}
+	h.Sum += cost
+	h.Count++
+}
+
+// record the request times and seconds of the path
+func record(path string, start time.Time) {
+	cost := timeCost(start)
+	label := metricLabel(path)
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	reqTimes[label]++
+	reqSeconds[label] += cost
+}
+
+// the registered route serving upath, so /randint/50 counts as /randint
+// and every served file as / instead of a series per path
+func metricLabel(upath string) string {
+	label := "/"
+	for _, route := range routes {
+		if (upath == route.Path || strings.HasPrefix(upath, route.Path+"/")) && len(route.Path) > len(label) {
+			label = route.Path
+		}
+	}
+	return label
+}
+
+// whether the client asks for a json response
+func wantJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// failure response in the format the client asks for, json, html or the plain "✘ Failed: msg"
+// curl -H "Accept: application/json" -X POST http://127.0.0.1:2333/move
+func writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	log.Println(fmt.Sprintf("Request error [%s %s %d]: %s", r.Method, r.URL.Path, status, msg))
+
+	// a compressing wrapper (Gzip) encodes the error body too, an encoding set
+	// for a sidecar or stored file that is not going to be sent no longer applies
+	if enc, ok := w.(interface{ Encoding() string }); ok {
+		w.Header().Set("Content-Encoding", enc.Encoding())
+	} else {
+		w.Header().Del("Content-Encoding")
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	switch {
+	case wantJSON(r):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "error": msg})
+	case strings.Contains(r.Header.Get("Accept"), "text/html"):
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<html lang=\"en\">\n<head><meta charset=\"UTF-8\" /><title>%d %s</title></head>\n<body>\n  <p>✘ Failed: %s</p>\n</body>\n</html>\n",
+			status, http.StatusText(status), template.HTMLEscapeString(msg))
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "✘ Failed: %s", msg)
+	}
+}
+
+// fields of a form or json (Content-Type: application/json) request body
+func requestFields(r *http.Request) (map[string]string, error) {
+	fields := make(map[string]string)
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&fields); err != nil {
+			return nil, fmt.Errorf("invalid json body: %s", err.Error())
+		}
+		return fields, nil
+	}
+
+	r.ParseForm()
+	for k := range r.Form {
+		fields[k] = r.Form.Get(k)
+	}
+	return fields, nil
+}
+
+// delete file
+// curl -X POST -d "filepath=bar/sample.pdf" http://127.0.0.1:2333/delete
+// curl -X POST -H "Content-Type: application/json" -d '{"filepath":"bar/sample.pdf"}' http://127.0.0.1:2333/delete
+// curl -X POST -H "Accept: application/json" -d "filepath=bar" http://127.0.0.1:2333/delete
+func remove(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	if readOnly {
+		writeError(w, r, http.StatusForbidden, "deleting is disabled, the server is read-only")
+		return
+	}
+
+	if r.Method == "POST" {
+		fields, err := requestFields(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		fpath := strings.TrimSpace(fields["filepath"])
+		if fpath == "" {
+			writeError(w, r, http.StatusBadRequest, "no file specified")
+			return
+		}
+
+		// keep the target inside dir, and never remove dir itself
+		fpath = path.Clean("/" + filepath.ToSlash(fpath))
+		if fpath == "/" {
+			writeError(w, r, http.StatusBadRequest, "refusing to delete the root directory")
+			return
+		}
+
+		// fmt.Println(dir, fpath, handler.Filename)
+		fullpath := storedPath(filepath.Join(dir, filepath.FromSlash(fpath)))
+
+		release, err := acquireWalk(r.Context())
+		if err != nil {
+			return // the client went away while queued
+		}
+		defer release()
+
+		// count what is going to be removed, a missing path is a no-op
+		isdir := false
+		removed := 0
+		if fi, err := os.Stat(fullpath); err == nil {
+			isdir = fi.IsDir()
+			filepath.Walk(fullpath, func(string, os.FileInfo, error) error {
+				removed++
+				return nil
+			})
+		}
+
+		if err := os.RemoveAll(fullpath); err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		log.Println("Delete file", fpath, "successfully")
+		if wantJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"path":    fpath,
+				"dir":     isdir,
+				"removed": removed,
+			})
+			return
+		}
+		fmt.Fprintf(w, "✔ Succeeded")
+	} else {
+		writeError(w, r, http.StatusMethodNotAllowed, "requst method must be post")
+	}
+}
+
+// move file or directory
+// curl -X POST -d "src=bar/sample.pdf" -d "dst=foo/sample.pdf" http://127.0.0.1:2333/move
+// curl -X POST -H "Content-Type: application/json" -d '{"src":"bar/sample.pdf","dst":"foo/sample.pdf"}' http://127.0.0.1:2333/move
+func move(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	if readOnly {
+		writeError(w, r, http.StatusForbidden, "moving is disabled, the server is read-only")
+		return
+	}
+
+	if r.Method != "POST" {
+		writeError(w, r, http.StatusMethodNotAllowed, "requst method must be post")
+		return
+	}
+
+	fields, err := requestFields(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	src := path.Clean("/" + strings.TrimSpace(fields["src"]))
+	dst := path.Clean("/" + strings.TrimSpace(fields["dst"]))
+	if src == "/" || dst == "/" {
+		writeError(w, r, http.StatusBadRequest, "src and dst must be specified")
+		return
+	}
+
+	srcpath := filepath.Join(dir, filepath.FromSlash(src))
+	dstpath := filepath.Join(dir, filepath.FromSlash(dst))
+	// a file stored by -compressstore keeps its .gz at the destination
+	if stored := storedPath(srcpath); stored != srcpath {
+		srcpath, dstpath = stored, dstpath+".gz"
+	}
+	if _, err := os.Stat(srcpath); err != nil {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("%s not found", src))
+		return
+	}
+	if _, err := os.Stat(dstpath); err == nil || storedPath(dstpath) != dstpath {
+		writeError(w, r, http.StatusConflict, fmt.Sprintf("%s already exists", dst))
+		return
+	}
+
+	mkdirAll(filepath.Dir(dstpath))
+	if err := os.Rename(srcpath, dstpath); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Println("Move file", src, "to", dst, "successfully")
+	if wantJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"src": src, "dst": dst})
+		return
+	}
+	fmt.Fprintf(w, "✔ Succeeded")
+}
+
+// upload file
+// curl -X POST -F "path=test" -F "file=@/home/xshrim/a.js" http://127.0.0.1:2333/upload
+// curl -X POST -F "file=@/home/xshrim/a.js" http://127.0.0.1:2333/upload/test/a.js
+// curl -X POST -F "file=@/home/xshrim/a.js" http://127.0.0.1:2333/upload/test/
+// curl -T /home/xshrim/a.js http://127.0.0.1:2333/upload/test/b.js
+func upload(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	defer record(r.URL.Path, start)
+
+	srv := requestServer(r)
+	relaxCSP(w, srv)
+
+	if r.Method == "GET" {
+		// crutime := time.Now().Unix()
+		// h := md5.New()
+		// io.WriteString(h, strconv.FormatInt(crutime, 10))
+		// token := fmt.Sprintf("%x", h.Sum(nil))
+		// t, _ := template.ParseFiles("front.html")
+
+		t, _ := template.New("index").Parse(html)
+
+		// t.Execute(w, token)
+		t.Execute(w, struct {
+			*Server
+			Motd     string
+			ReadOnly bool
+		}{srv, getMotd(), readOnly})
+		return
+	}
+
+	if readOnly {
+		writeError(w, r, http.StatusForbidden, "uploads are disabled, the server is read-only")
+		return
+	}
+
+	// Content-Encoding: gzip bodies are decompressed, the gzip reader checks the
+	// CRC and length footer so a truncated stream fails instead of leaving a partial file
+	if enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc == "gzip" || enc == "x-gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid gzip body: "+err.Error())
+			return
+		}
+		defer gz.Close()
+		r.Body = io.NopCloser(gz)
+		r.ContentLength = -1
+	}
+
+	// PUT /upload/<path> may carry the raw file as the body
+	var file io.Reader
+	var name string
+	src := &sourceReader{}
+	var mr *multipart.Reader
+	pathField := r.URL.Query().Get("path")
+	target := strings.TrimPrefix(r.URL.Path, "/upload")
+	if r.Method == "PUT" && !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		if target == "" || strings.HasSuffix(target, "/") {
+			writeError(w, r, http.StatusBadRequest, "PUT needs a file path after /upload/")
+			return
+		}
+		src.r = r.Body
+		file, name = src, path.Base(target)
+		log.Println(fmt.Sprintf("Receiving file [filename: %+v, filesize: %+vB", name, r.ContentLength))
+	} else {
+		// the multipart body is streamed, the form fields before the file
+		// part are read and the file part itself is copied as it arrives
+		var err error
+		mr, err = r.MultipartReader()
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "no file part: "+err.Error())
+				return
+			}
+			if part.FormName() == "file" {
+				src.r = part
+				file, name = src, part.FileName()
+				log.Println(fmt.Sprintf("Receiving file [filename: %+v, httpheader: %+v", name, part.Header))
+				break
+			}
+			if part.FormName() == "path" {
+				value, _ := io.ReadAll(io.LimitReader(part, maxFieldSize))
+				pathField = string(value)
+			}
+		}
+	}
+
+	// tempFile, err := ioutil.TempFile(filePath, handler.Filename)
+	// the url path is the full destination, a trailing slash means a directory
+	// that keeps the multipart filename, without one the path form field is used
+	switch {
+	case target == "" || target == "/":
+		target = strings.TrimSpace(pathField) + "/" + name
+	case strings.HasSuffix(target, "/"):
+		target += name
+	default:
+		name = path.Base(target)
+	}
+
+	if !uploadAllowed(name) {
+		writeError(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("extension %q of %s is not allowed", extLabel(name), name))
+		return
+	}
+
+	// -quota bytes per client ip within the rolling -quotawindow, the bytes are
+	// reserved up front (the Content-Length when known) and settled once stored
+	ip := clientIP(r)
+	left := int64(-1)
+	var settled int64 // the reservation is released unless the upload is stored
+	if quota > 0 {
+		reserved, retry := quotaReserve(ip, r.ContentLength)
+		if reserved == nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+			writeError(w, r, http.StatusTooManyRequests, fmt.Sprintf("upload quota of %d bytes per %s exceeded", quota, quotaWindow))
+			return
+		}
+		defer func() { quotaSettle(ip, reserved, settled) }()
+		left = reserved.size
+		file = io.LimitReader(file, left+1)
+	}
+
+	// keep the destination inside dir, and inside -uploaddir when set
+	upath := path.Clean("/" + filepath.ToSlash(target))
+	if uploadDir != "" {
+		upath = path.Join(uploadDir, upath)
+	}
+	if maxDepth > 0 && strings.Count(upath, "/") > maxDepth {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("%s exceeds the maximum depth of %d", upath, maxDepth))
+		return
+	}
+
+	// fmt.Println(dir, fpath, handler.Filename)
+	fullpath := filepath.Join(dir, filepath.FromSlash(upath))
+
+	mkdirAll(filepath.Dir(fullpath))
+
+	// serialize concurrent uploads to the same path, the last writer wins
+	// -compressstore keeps uploads gzipped at rest as name.gz, names already
+	// ending in .gz too, so every stored name maps back to exactly one file
+	storepath := fullpath
+	gzipped := compressStore
+	if gzipped {
+		storepath += ".gz"
+	}
+
+	unlock := lockPath(storepath)
+	defer unlock()
+
+	// optimistic concurrency, If-None-Match: * only creates and If-Match only replaces the given version
+	if status, err := uploadPreconditions(r, storepath); err != nil {
+		writeError(w, r, status, err.Error())
+		return
+	}
+
+	// write to a .part temp file first and rename it when finished,
+	// so nobody (e.g. the organize sweeper) sees a half written file,
+	// with -tmpdir the partial uploads stay off the served volume
+	tmppath := storepath + ".part"
+	var tmp *os.File
+	var err error
+	if tmpDir != "" {
+		tmp, err = os.CreateTemp(tmpDir, "gofs-*.part")
+	} else {
+		tmp, err = os.OpenFile(tmppath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(fileMode))
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	tmppath = tmp.Name()
+
+	// listed on /uploads/active until done, POST /uploads/<id>/cancel aborts it
+	active := trackUpload(r, upath, ip, file)
+	defer untrackUpload(active)
+	file = active
+
+	var size int64
+	if gzipped {
+		gz := gzip.NewWriter(tmp)
+		if size, err = io.Copy(gz, file); err == nil {
+			err = gz.Close()
+		}
+	} else {
+		size, err = io.Copy(tmp, file)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmppath)
+		if active.ctx.Err() != nil {
+			writeError(w, r, http.StatusConflict, "upload canceled")
+			return
+		}
+		if src.err != nil {
+			// the client's fault, e.g. a truncated or corrupt gzip body
+			writeError(w, r, http.StatusBadRequest, "incomplete upload: "+src.err.Error())
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	tmp.Close()
+
+	// a path field after the file part came too late to place the file,
+	// rather than storing it in the wrong place the upload is refused
+	for mr != nil {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		if part.FormName() == "path" {
+			os.Remove(tmppath)
+			writeError(w, r, http.StatusBadRequest, "the path field must come before the file part")
+			return
+		}
+	}
+
+	if left >= 0 && size > left {
+		os.Remove(tmppath)
+		writeError(w, r, http.StatusTooManyRequests, fmt.Sprintf("upload exceeds the remaining quota of %d bytes", left))
+		return
+	}
+	os.Chmod(tmppath, os.FileMode(fileMode)) // not masked by the umask
+
+	if scanCmd != "" {
+		if status, err := scan(tmppath); err != nil {
+			os.Remove(tmppath)
+			writeError(w, r, status, err.Error())
+			return
+		}
+	}
+
+	if err := moveFile(tmppath, storepath); err != nil {
+		os.Remove(tmppath)
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	settled = size
+	if fi, err := os.Stat(storepath); err == nil {
+		w.Header().Set("ETag", fileETag(fi))
+	}
+
+	if mirror != "" {
+		queueMirror(mirrorJob{upath: upath, storepath: storepath, gzipped: gzipped})
+	}
+
+	observeTransfer("upload", start)
+	log.Println("Receive file successfully")
+
+	// browsers get a small confirmation page in the iframe, curl gets plain text
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		rel, _ := filepath.Rel(dir, fullpath)
+		rel = filepath.ToSlash(rel)
+		link := srv.URL("/" + rel)
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		t, _ := template.New("uploaded").Parse(uploadedHTML)
+		t.Execute(w, map[string]interface{}{
+			"Name": name,
+			"Size": size,
+			"Path": "/" + rel,
+			"Link": link,
+		})
+		return
+	}
+
+	fmt.Fprintf(w, "✔ Succeeded")
+
+}
+
+type idempotentResult struct {
+	request     string // method and path the key was first used for
+	pending     bool
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+var idempotencyTTL time.Duration
+var idempotencyMu sync.Mutex
+var idempotency = make(map[string]*idempotentResult)
+
+// response writer keeping a copy of the body
+type captureWriter struct {
+	*statusRecorder
+	body bytes.Buffer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.statusRecorder.Write(b)
+}
+
+// Idempotency-Key
+// a repeated key within -idempotencyttl replays the first successful upload instead of storing again,
+// keys are scoped to the client (ip and credentials), reusing one for another request is a 422
+// curl -H "Idempotency-Key: 1f6e" -F "file=@/home/xshrim/a.js" http://127.0.0.1:2333/upload
+func Idempotent(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if idempotencyTTL <= 0 || key == "" || (r.Method != "POST" && r.Method != "PUT") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeError(w, r, http.StatusBadRequest, "Idempotency-Key is longer than 255 characters")
+			return
+		}
+
+		// the same key sent by different clients never collides
+		client := clientIP(r)
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			sum := sha256.Sum256([]byte(auth))
+			client += " " + hex.EncodeToString(sum[:8])
+		}
+		key = client + " " + key
+		request := r.Method + " " + path.Clean("/"+r.URL.Path)
+
+		idempotencyMu.Lock()
+		now := time.Now()
+		for k, res := range idempotency {
+			if !res.pending && now.After(res.expires) {
+				delete(idempotency, k)
+			}
+		}
+		res, ok := idempotency[key]
+		if !ok {
+			idempotency[key] = &idempotentResult{request: request, pending: true}
+		}
+		idempotencyMu.Unlock()
+
+		if ok && res.request != request {
+			writeError(w, r, http.StatusUnprocessableEntity, "Idempotency-Key was already used for "+res.request)
+			return
+		}
+		if ok && res.pending {
+			writeError(w, r, http.StatusConflict, "an upload with this Idempotency-Key is in progress")
+			return
+		}
+		if ok {
+			log.Println("Replay upload for Idempotency-Key", r.Header.Get("Idempotency-Key"))
+			w.Header().Set("Content-Type", res.contentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(res.status)
+			w.Write(res.body)
+			return
+		}
+
+		cw := &captureWriter{statusRecorder: &statusRecorder{ResponseWriter: w}}
+		handler.ServeHTTP(cw, r)
+
+		idempotencyMu.Lock()
+		defer idempotencyMu.Unlock()
+		// only successes are remembered, a failed upload can be retried with the same key
+		if cw.status == 0 || cw.status >= 300 {
+			delete(idempotency, key)
+			return
+		}
+		ctype := w.Header().Get("Content-Type")
+		if ctype == "" {
+			ctype = http.DetectContentType(cw.body.Bytes())
+		}
+		idempotency[key] = &idempotentResult{
+			request:     request,
+			status:      cw.status,
+			contentType: ctype,
+			body:        cw.body.Bytes(),
+			expires:     time.Now().Add(idempotencyTTL),
+		}
+	})
+}
+
+type quotaEvent struct {
+	at      time.Time
+	size    int64
+	pending bool // reserved by an upload in progress
+}
+
+var quota int64
+var quotaWindow time.Duration
+var quotaMu sync.Mutex
+var quotaUsage = make(map[string][]*quotaEvent)
+
+// reserve up to want bytes of the quota of ip for an upload in progress (all that
+// is left when want <= 0), so concurrent uploads cannot overrun it together,
+// nil and the time until the oldest upload leaves the window when nothing is left
+func quotaReserve(ip string, want int64) (*quotaEvent, time.Duration) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	now := time.Now()
+	var events []*quotaEvent
+	used := int64(0)
+	oldest := now
+	for _, e := range quotaUsage[ip] {
+		if e.pending || now.Sub(e.at) < quotaWindow {
+			events = append(events, e)
+			used += e.size
+			if !e.pending && e.at.Before(oldest) {
+				oldest = e.at
+			}
+		}
+	}
+
+	left := quota - used
+	if left <= 0 {
+		quotaUsage[ip] = events
+		return nil, quotaWindow - now.Sub(oldest)
+	}
+	if want <= 0 || want > left {
+		want = left
+	}
+	reserved := &quotaEvent{at: now, size: want, pending: true}
+	quotaUsage[ip] = append(events, reserved)
+	return reserved, 0
+}
+
+// settle a reservation to the bytes actually stored, 0 releases it
+func quotaSettle(ip string, reserved *quotaEvent, size int64) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	if size > 0 {
+		reserved.at, reserved.size, reserved.pending = time.Now(), size, false
+		return
+	}
+	events := quotaUsage[ip][:0]
+	for _, e := range quotaUsage[ip] {
+		if e != reserved {
+			events = append(events, e)
+		}
+	}
+	if len(events) == 0 {
+		delete(quotaUsage, ip)
+		return
+	}
+	quotaUsage[ip] = events
+}
+
+// in-flight upload, reading through it counts the received bytes
+// and fails once it is canceled
+type activeUpload struct {
+	id       string
+	path     string
+	clientIP string
+	started  time.Time
+	received int64
+	r        io.Reader
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func (u *activeUpload) Read(b []byte) (int, error) {
+	if err := u.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := u.r.Read(b)
+	atomic.AddInt64(&u.received, int64(n))
+	return n, err
+}
+
+var uploadSeq uint64
+var activeUploadsMu sync.Mutex
+var activeUploads = make(map[string]*activeUpload)
+
+func trackUpload(r *http.Request, upath string, ip string, file io.Reader) *activeUpload {
+	ctx, cancel := context.WithCancel(r.Context())
+	u := &activeUpload{
+		id:       strconv.FormatUint(atomic.AddUint64(&uploadSeq, 1), 10),
+		path:     upath,
+		clientIP: ip,
+		started:  time.Now(),
+		r:        file,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	activeUploadsMu.Lock()
+	activeUploads[u.id] = u
+	activeUploadsMu.Unlock()
+	return u
+}
+
+func untrackUpload(u *activeUpload) {
+	activeUploadsMu.Lock()
+	delete(activeUploads, u.id)
+	activeUploadsMu.Unlock()
+	u.cancel()
+}
+
+// in-flight uploads, and canceling one of them (needs -auth)
+// curl http://127.0.0.1:2333/uploads/active
+// curl -u user:pass -X POST http://127.0.0.1:2333/uploads/3/cancel
+func uploads(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	upath := strings.Trim(strings.TrimPrefix(r.URL.Path, "/uploads"), "/")
+	if upath == "active" {
+		type entry struct {
+			ID       string    `json:"id"`
+			Path     string    `json:"path"`
+			Received int64     `json:"received"`
+			ClientIP string    `json:"client_ip"`
+			Started  time.Time `json:"started"`
+			Elapsed  float64   `json:"elapsed"`
+		}
+		entries := []entry{}
+		activeUploadsMu.Lock()
+		for _, u := range activeUploads {
+			entries = append(entries, entry{u.id, u.path, atomic.LoadInt64(&u.received), u.clientIP, u.started, time.Since(u.started).Seconds()})
+		}
+		activeUploadsMu.Unlock()
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Started.Before(entries[j].Started) })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+
+	id, action, _ := strings.Cut(upath, "/")
+	if action != "cancel" {
+		writeError(w, r, http.StatusNotFound, "usage /uploads/active or /uploads/<id>/cancel")
+		return
+	}
+	if r.Method != "POST" {
+		writeError(w, r, http.StatusMethodNotAllowed, "requst method must be post")
+		return
+	}
+	if authCred == "" {
+		writeError(w, r, http.StatusForbidden, "canceling uploads is disabled, start with -auth")
+		return
+	}
+	if !checkAuth(r, authCred) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gofs"`)
+		writeError(w, r, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	activeUploadsMu.Lock()
+	u, ok := activeUploads[id]
+	activeUploadsMu.Unlock()
+	if !ok {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("upload %s not found", id))
+		return
+	}
+	u.cancel()
+
+	log.Println("Cancel upload", id, "of", u.path)
+	fmt.Fprintf(w, "✔ Succeeded")
+}
+
+// reader remembering the error of the upload source, to tell it from write errors
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// strong validator of a file version, from its mtime and size
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// whether the If-Match/If-None-Match list contains etag or *
+func matchETag(list string, etag string) bool {
+	for _, tag := range strings.Split(list, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func uploadPreconditions(r *http.Request, storepath string) (int, error) {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return http.StatusOK, nil
+	}
+
+	etag := ""
+	if fi, err := os.Stat(storepath); err == nil {
+		etag = fileETag(fi)
+	}
+	if ifMatch != "" && (etag == "" || !matchETag(ifMatch, etag)) {
+		return http.StatusPreconditionFailed, fmt.Errorf("the target does not match If-Match")
+	}
+	if ifNoneMatch != "" && etag != "" && matchETag(ifNoneMatch, etag) {
+		return http.StatusPreconditionFailed, fmt.Errorf("the target matches If-None-Match")
+	}
+	return http.StatusOK, nil
+}
+
+// run the -scan command against the uploaded temp file, a non-zero exit rejects it
+func scan(tmppath string) (int, error) {
+	args := strings.Fields(scanCmd)
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], append(args[1:], tmppath)...)
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		return http.StatusUnprocessableEntity, fmt.Errorf("rejected by scan: %s", strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+var snapshotMu sync.RWMutex
+var snapshotPath string
+
+// the directory files are served from, the current snapshot when -snapshot is on
+func servedDir() string {
+	snapshotMu.RLock()
+	defer snapshotMu.RUnlock()
+	if snapshotPath != "" {
+		return snapshotPath
+	}
+	return dir
+}
+
+// take a point-in-time snapshot of dir by copying it and serve from it, hardlinks
+// would share the files that are written in place (motd, counters) with dir
+func takeSnapshot() error {
+	release, _ := acquireWalk(context.Background())
+	defer release()
+
+	snap, err := os.MkdirTemp(snapshotDir, "gofs-snapshot-")
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(dir, func(src string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, src)
+		dst := filepath.Join(snap, rel)
+		switch {
+		case fi.IsDir():
+			// do not snapshot the snapshots when they live inside dir
+			if strings.HasPrefix(fi.Name(), "gofs-snapshot-") && filepath.Dir(src) == snapshotDir {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(dst, fi.Mode().Perm())
+		case fi.Mode().IsRegular():
+			if err := copyFile(src, dst, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			// keep Last-Modified and the ETags of the snapshot in line with dir
+			return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+		}
+		return nil // symlinks and special files are skipped
+	})
+	if err != nil {
+		os.RemoveAll(snap)
+		return err
+	}
+
+	snapshotMu.Lock()
+	old := snapshotPath
+	snapshotPath = snap
+	snapshotMu.Unlock()
+
+	// open files of in-flight downloads stay readable after the removal
+	if old != "" {
+		os.RemoveAll(old)
+	}
+	log.Println(fmt.Sprintf("snapshot path: <%s>", snap))
+	return nil
+}
+
+// remove the current snapshot on shutdown, so the snapshot dir does not fill up across runs
+func removeSnapshot() {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	if snapshotPath != "" {
+		os.RemoveAll(snapshotPath)
+		snapshotPath = ""
+	}
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+var tmpDir string
+
+// os.Rename, a variable so the cross-device fallback can be exercised
+var rename = os.Rename
+
+// rename src to dst, across filesystems (-tmpdir on another device) src is copied
+// next to dst first, so dst still appears atomically
+func moveFile(src, dst string) error {
+	err := rename(src, dst)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+
+	if err := copyFile(src, dst+".part", os.FileMode(fileMode)); err != nil {
+		os.Remove(dst + ".part")
+		return err
+	}
+	if err := rename(dst+".part", dst); err != nil {
+		os.Remove(dst + ".part")
+		return err
+	}
+	os.Chmod(dst, os.FileMode(fileMode))
+	return os.Remove(src)
+}
+
+type mirrorJob struct {
+	upath     string
+	storepath string
+	gzipped   bool
+}
+
+var mirror string
+var mirrorQueue = make(chan mirrorJob, 1024)
+var mirrorPending sync.WaitGroup
+
+// replicate an upload to -mirror in the background, the client does not wait for it
+func queueMirror(job mirrorJob) {
+	mirrorPending.Add(1)
+	select {
+	case mirrorQueue <- job:
+	default:
+		mirrorPending.Done()
+		log.Println("Mirror error: queue full, dropped", job.upath)
+	}
+}
+
+// mirror worker, each upload is tried a few times with backoff before giving up
+func mirrorUploads() {
+	for job := range mirrorQueue {
+		var err error
+		for attempt, backoff := 1, time.Second; attempt <= 3; attempt, backoff = attempt+1, backoff*2 {
+			if err = mirrorUpload(job); err == nil {
+				log.Println("Mirror", job.upath, "successfully")
+				break
+			}
+			log.Println(fmt.Sprintf("Mirror error (attempt %d): %s", attempt, err.Error()))
+			if attempt < 3 {
+				time.Sleep(backoff)
+			}
+		}
+		if err != nil {
+			log.Println("Mirror error: gave up on", job.upath)
+		}
+		mirrorPending.Done()
+	}
+}
+
+// PUT the file to another gofs, or copy it below a second directory
+func mirrorUpload(job mirrorJob) error {
+	if !strings.HasPrefix(mirror, "http://") && !strings.HasPrefix(mirror, "https://") {
+		dst := filepath.Join(mirror, filepath.FromSlash(job.upath))
+		if job.gzipped {
+			dst += ".gz"
+		}
+		if err := mkdirAll(filepath.Dir(dst)); err != nil {
+			return err
+		}
+		if err := copyFile(job.storepath, dst+".part", os.FileMode(fileMode)); err != nil {
+			os.Remove(dst + ".part")
+			return err
+		}
+		return os.Rename(dst+".part", dst)
+	}
+
+	f, err := os.Open(job.storepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	req, err := http.NewRequest("PUT", strings.TrimSuffix(mirror, "/")+(&url.URL{Path: "/upload" + job.upath}).EscapedPath(), f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if job.gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := (&http.Client{Timeout: 10 * time.Minute}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// move files dropped in the root of dir into YYYY/MM/DD subfolders by mtime
+func organize(interval time.Duration) {
+	for range time.Tick(interval) {
+		organizeOnce()
+	}
+}
+
+// whether fullpath is one of the files gofs keeps its own state in
+// (-counterfile, -motdfile, -metricsstate), which may live inside dir
+func stateFile(fullpath string) bool {
+	for _, name := range []string{counterFile, motdFile, metricsState} {
+		if name != "" && filepath.Clean(name) == fullpath {
+			return true
+		}
+	}
+	return false
+}
+
+// one sweep of organize
+func organizeOnce() {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		log.Println("Organize error: ", err.Error())
+		return
+	}
+
+	for _, de := range des {
+		// skip directories, files still being uploaded and the state files
+		src := filepath.Join(dir, de.Name())
+		if !de.Type().IsRegular() || strings.HasSuffix(de.Name(), ".part") || stateFile(src) {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+
+		dst := filepath.Join(dir, fi.ModTime().Format("2006/01/02"), de.Name())
+		if _, err := os.Stat(dst); err == nil {
+			log.Println("Organize file", de.Name(), "skipped: destination exists")
+			continue
+		}
+
+		mkdirAll(filepath.Dir(dst))
+		if err := os.Rename(src, dst); err != nil {
+			log.Println("Organize file error: ", err.Error())
+			continue
+		}
+		log.Println("Organize file", de.Name(), "to", dst)
+	}
+}
+
+func delay(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	delay := strings.TrimPrefix(r.URL.Path, "/delay/")
+	if r.URL.Path == "/delay" {
+		delay = ""
+	}
+
+	if delay != "" {
+		var err error
+		sec, err := strconv.Atoi(delay)
+		dur := time.Duration(sec) * time.Second
+		if err != nil {
+			dur, err = time.ParseDuration(delay)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid delay %q, use seconds or a duration like 1.5s", delay))
+				return
+			}
+		}
+		time.Sleep(dur)
+		fmt.Fprintf(w, "(%s later) ", dur)
+	}
+
+	fmt.Fprintf(w, "[Headers]:\n")
+
+	for name, headers := range r.Header {
+		for _, h := range headers {
+			fmt.Fprintf(w, "%v: %v\n", name, h)
+		}
+	}
+}
+
+// read the request body, transparently decompressing Content-Encoding gzip or deflate,
+// returns the status to fail with when the body is malformed or too large
+func readBody(r *http.Request) ([]byte, int, error) {
+	var body io.Reader = r.Body
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		defer gz.Close()
+		body = gz
+	case "deflate":
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content encoding %q", enc)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, maxBodySize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if len(data) > maxBodySize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %d bytes", maxBodySize)
+	}
+	return data, http.StatusOK, nil
+}
+
+// curl -H "Content-Encoding: gzip" --data-binary @body.gz http://127.0.0.1:2333/echo
+// curl "http://127.0.0.1:2333/echo?trailer=Grpc-Status=0,Grpc-Message=ok" --raw
+func echo(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	body, status, err := readBody(r)
+	if err != nil {
+		writeError(w, r, status, err.Error())
+		return
+	}
+
+	reg := regexp.MustCompile(`/echo/?(\d*)/?([^/]*)/?(\S*)`) // 中文括号，例如：华南地区（广州） -> 广州
+	matches := reg.FindStringSubmatch(r.URL.Path)
+	scode := matches[1]
+	headers := matches[2]
+	content := matches[3]
+
+	for _, header := range strings.Split(headers, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		kv := strings.Split(header, "=")
+		name := strings.TrimSpace(kv[0])
+		value := strings.TrimSpace(kv[1])
+		w.Header().Add(name, value)
+	}
+
+	// request trailers are only known once the body is fully consumed
+	io.Copy(io.Discard, io.LimitReader(r.Body, maxBodySize))
+
+	// ?trailer=k=v,k2=v2 are sent as response trailers after the body
+	trailers := make(map[string]string)
+	for _, trailer := range strings.Split(r.URL.Query().Get("trailer"), ",") {
+		name, value, _ := strings.Cut(trailer, "=")
+		if name = strings.TrimSpace(name); name != "" {
+			trailers[http.CanonicalHeaderKey(name)] = strings.TrimSpace(value)
+			w.Header().Add("Trailer", name)
+		}
+	}
+
+	code, err := strconv.Atoi(scode)
+	if err != nil {
+		code = 200
+	}
+
+	w.WriteHeader(code)
+
+	fmt.Fprintf(w, ">>> %s %s %s\n", r.Method, r.URL, r.Proto)
+	fmt.Fprintf(w, ">>> Host: %s\n", r.Host)
+	for name, headers := range r.Header {
+		for _, h := range headers {
+			fmt.Fprintf(w, ">>> %v: %v\n", name, h)
+		}
+	}
+	fmt.Fprintf(w, "\n")
+
+	fmt.Fprintf(w, "<<< %s %d %s\n", r.Proto, code, http.StatusText(code))
+	for name, headers := range w.Header() {
+		for _, h := range headers {
+			fmt.Fprintf(w, "<<< %v: %v\n", name, h)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%s\n", content)
+	if len(body) > 0 {
+		fmt.Fprintf(w, "%s\n", body)
+	}
+
+	for name, values := range r.Trailer {
+		for _, v := range values {
+			fmt.Fprintf(w, ">>> Trailer %v: %v\n", name, v)
+		}
+	}
+
+	for name, value := range trailers {
+		w.Header().Set(name, value)
+	}
+}
+
+// small fixed size plain text body, sent with its Content-Length
+// unless a compressing wrapper already took over the encoding
+func writeText(w http.ResponseWriter, s string) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if w.Header().Get("Content-Encoding") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(s)))
+	}
+	io.WriteString(w, s)
+}
+
+func ip(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	writeText(w, GetLocalIP())
+}
+
+func (s *Server) uuid(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	b := make([]byte, 16)
+	_, err := s.Rand.Read(b)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeText(w, fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+}
+
+func (s *Server) randint(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	maxstr := strings.TrimPrefix(r.URL.Path, "/randint/")
+	if r.URL.Path == "/randint" {
+		maxstr = ""
+	}
+
+	max, err := strconv.Atoi(maxstr)
+	if err != nil {
+		// fmt.Fprintf(w, err.Error())
+		// return
+		max = 100
+	}
+	if max <= 0 {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid max %d: must be positive", max))
+		return
+	}
+
+	writeText(w, strconv.Itoa(s.Rand.Intn(max)))
+}
+
+func (s *Server) randstr(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	lengthstr := strings.TrimPrefix(r.URL.Path, "/randstr/")
+	if r.URL.Path == "/randstr" {
+		lengthstr = ""
+	}
+
+	length, err := strconv.Atoi(lengthstr)
+	if err != nil {
+		// fmt.Fprintf(w, err.Error())
+		// return
+		length = 12
+	}
+	if length < 0 || length > maxRandLength {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid length %d: must be between 0 and %d", length, maxRandLength))
+		return
+	}
+
+	letters := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890+=-_@#~,.[]()!%^*$"
+
+	var lr = []rune(letters)
+	rnd := s.Rand
+	if length == 0 {
+		length = rnd.Intn(100) + 1
+	}
+
+	b := make([]rune, length)
+	for i := range b {
+		b[i] = lr[rnd.Intn(len(lr))]
+	}
+
+	writeText(w, string(b))
+}
+
+func ts(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	writeText(w, strconv.FormatInt(time.Now().UnixMilli(), 10))
+}
+
+func dt(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	writeText(w, time.Now().Local().Format("2006-01-02 15:04:05"))
+}
+
+// clock skew between server and client, skew = server - client in milliseconds
+// curl -X GET "http://127.0.0.1:2333/clockskew?client=$(date +%s%3N)"
+func clockskew(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	server := time.Now().UnixMilli()
+
+	client, err := strconv.ParseInt(r.URL.Query().Get("client"), 10, 64)
+	if err != nil || client <= 0 {
+		writeError(w, r, http.StatusBadRequest, "client must be a unix timestamp in milliseconds")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{
+		"server": server,
+		"client": client,
+		"skew":   server - client,
+	})
+}
+
+// stream the tree of fullpath as nested json, depth < 0 means unbounded
+func writeTree(w io.Writer, fullpath string, fi os.FileInfo, depth int) {
+	name, _ := json.Marshal(servedName(fs.FileInfoToDirEntry(fi)))
+	mtime, _ := json.Marshal(fi.ModTime())
+	fmt.Fprintf(w, `{"name":%s,"dir":%t,"size":%d,"mtime":%s`, name, fi.IsDir(), fi.Size(), mtime)
+
+	if fi.IsDir() && depth != 0 {
+		fmt.Fprintf(w, `,"children":[`)
+		des, err := os.ReadDir(fullpath)
+		if err != nil {
+			log.Println("Read directory error: ", err.Error())
+		}
+		n := 0
+		for _, de := range des {
+			// symlinks are not followed, so the walk stays inside dir
+			info, err := de.Info()
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				fmt.Fprintf(w, ",")
+			}
+			writeTree(w, filepath.Join(fullpath, de.Name()), info, depth-1)
+			n++
+		}
+		fmt.Fprintf(w, "]")
+	}
+
+	fmt.Fprintf(w, "}")
+}
+
+var walkers int
+var walkSlots chan struct{}
+var walksActive int64
+
+// wait for one of the -walkers slots shared by the directory walks (tree, manifest,
+// delete, snapshot), so concurrent requests cannot exhaust file descriptors or io,
+// an error means ctx ended while waiting
+func acquireWalk(ctx context.Context) (func(), error) {
+	if walkSlots != nil {
+		select {
+		case walkSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	atomic.AddInt64(&walksActive, 1)
+	return func() {
+		atomic.AddInt64(&walksActive, -1)
+		if walkSlots != nil {
+			<-walkSlots
+		}
+	}, nil
+}
+
+// recursive listing
+// curl -X GET "http://127.0.0.1:2333/tree/bar?depth=2"
+func tree(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	upath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/tree"))
+	fullpath := storedPath(filepath.Join(servedDir(), filepath.FromSlash(upath)))
+
+	depth := maxTreeDepth
+	if d := r.URL.Query().Get("depth"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, "depth must be a non-negative integer")
+			return
+		}
+		if n < depth {
+			depth = n
+		}
+	}
+
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("%s not found", upath))
+		return
+	}
+
+	release, err := acquireWalk(r.Context())
+	if err != nil {
+		return // the client went away while queued
+	}
+	defer release()
+
+	modtime, count, total := treeState(fullpath, fi, depth)
+	if fresh(w, r, aggregateETag(r, modtime, count, total), modtime) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeTree(w, fullpath, fi, depth)
+}
+
+// newest mtime, number of entries and total size of the tree writeTree walks
+func treeState(fullpath string, fi os.FileInfo, depth int) (time.Time, int, int64) {
+	modtime, count, total := fi.ModTime(), 1, fi.Size()
+	if !fi.IsDir() || depth == 0 {
+		return modtime, count, total
+	}
+	des, _ := os.ReadDir(fullpath)
+	for _, de := range des {
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		m, c, t := treeState(filepath.Join(fullpath, de.Name()), info, depth-1)
+		if m.After(modtime) {
+			modtime = m
+		}
+		count += c
+		total += t
+	}
+	return modtime, count, total
+}
+
+// strong validator of a response generated from a directory tree, from its
+// aggregate state and the query selecting the representation
+func aggregateETag(r *http.Request, modtime time.Time, count int, total int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%d|%d|%s|%s", modtime.UnixNano(), count, total, r.URL.Path, r.URL.RawQuery)))
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// set ETag and Last-Modified and tell whether the client copy is still fresh,
+// in which case 304 has been written, If-None-Match wins over If-Modified-Since
+func fresh(w http.ResponseWriter, r *http.Request, etag string, modtime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" {
+		return notModified(w, r, modtime)
+	}
+
+	if !modtime.IsZero() {
+		w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if (r.Method != "GET" && r.Method != "HEAD") || !matchETag(strings.ReplaceAll(inm, "W/", ""), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// set Last-Modified and tell whether the client copy is still fresh,
+// in which case 304 has been written
+func notModified(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
+	if modtime.IsZero() {
+		return false
+	}
+	w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modtime.Truncate(time.Second).After(ims) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// version of gofs, set by go build -ldflags "-X main.Version=v1.0.0"
+// curl -X GET http://127.0.0.1:2333/version
+func version(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	if notModified(w, r, startTime) {
+		return
+	}
+
+	writeText(w, Version)
+}
+
+type checksum struct {
+	modTime time.Time
+	size    int64
+	sum     string
+	length  int64 // of the content as served
+}
+
+var checksumsMu sync.Mutex
+var checksums = make(map[string]checksum)
+
+// sha256 and length of the file as served, cached until its mtime or size changes
+func fileChecksum(fullpath string, fi os.FileInfo) (string, int64, error) {
+	checksumsMu.Lock()
+	c, ok := checksums[fullpath]
+	checksumsMu.Unlock()
+	if ok && c.modTime.Equal(fi.ModTime()) && c.size == fi.Size() {
+		return c.sum, c.length, nil
+	}
+
+	f, err := os.Open(fullpath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	// -compressstore files are hashed as served, decompressed
+	var content io.Reader = f
+	if compressStore && strings.HasSuffix(fullpath, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return "", 0, err
+		}
+		content = gz
+	}
+
+	h := sha256.New()
+	length, err := io.Copy(h, content)
+	if err != nil {
+		return "", 0, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	checksumsMu.Lock()
+	checksums[fullpath] = checksum{modTime: fi.ModTime(), size: fi.Size(), sum: sum, length: length}
+	checksumsMu.Unlock()
+
+	return sum, length, nil
+}
+
+// re-hash a stored file and compare it with the expected sha256
+// curl -X GET "http://127.0.0.1:2333/verify/bar/sample.pdf?sha256=9f86d0..."
+func verify(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	upath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/verify"))
+	fullpath := storedPath(filepath.Join(servedDir(), filepath.FromSlash(upath)))
+
+	fi, err := os.Stat(fullpath)
+	if err != nil || !fi.Mode().IsRegular() {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("%s not found", upath))
+		return
+	}
+
+	expected := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("sha256")))
+	if _, err := hex.DecodeString(expected); err != nil || (expected != "" && len(expected) != sha256.Size*2) {
+		writeError(w, r, http.StatusBadRequest, "sha256 must be 64 hex characters")
+		return
+	}
+
+	sum, _, err := fileChecksum(fullpath, fi)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	result := map[string]interface{}{"path": upath, "sha256": sum}
+	if expected != "" {
+		result["match"] = sum == expected
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+var hls bool
+var ffmpegPath string
+var hlsDir string
+
+// sources /hls segments, by extension
+var hlsSources = map[string]bool{".mp4": true, ".m4v": true, ".mov": true, ".mkv": true, ".webm": true, ".avi": true, ".ts": true}
+
+// HLS preview of a video (-hls), segmented by ffmpeg on first request and cached
+// until the source changes, segments are at <path>.m3u8/<segment>
+// curl http://127.0.0.1:2333/hls/bar/movie.mp4.m3u8
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	if !hls {
+		writeError(w, r, http.StatusNotFound, "hls is disabled, start with -hls")
+		return
+	}
+	if ffmpegPath == "" {
+		writeError(w, r, http.StatusNotImplemented, "hls needs ffmpeg, which was not found")
+		return
+	}
+
+	upath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/hls"))
+	segment := ""
+	if i := strings.Index(upath, ".m3u8/"); i >= 0 {
+		upath, segment = upath[:i+len(".m3u8")], upath[i+len(".m3u8/"):]
+	}
+	if !strings.HasSuffix(upath, ".m3u8") {
+		writeError(w, r, http.StatusNotFound, "usage /hls/<video>.m3u8")
+		return
+	}
+	source := strings.TrimSuffix(upath, ".m3u8")
+	fullpath := filepath.Join(servedDir(), filepath.FromSlash(source))
+
+	fi, err := os.Stat(fullpath)
+	if err != nil || !fi.Mode().IsRegular() {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("%s not found", source))
+		return
+	}
+	if !hlsSources[strings.ToLower(filepath.Ext(fullpath))] {
+		writeError(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("%s is not a supported video", source))
+		return
+	}
+
+	out, err := segmentVideo(fullpath, fi)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if segment != "" {
+		if strings.Contains(segment, "/") || !strings.HasSuffix(segment, ".ts") {
+			writeError(w, r, http.StatusNotFound, fmt.Sprintf("%s not found", segment))
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		http.ServeFile(w, r, filepath.Join(out, segment))
+		return
+	}
+
+	// segment uris relative to the playlist url
+	playlist, err := os.ReadFile(filepath.Join(out, "index.m3u8"))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	prefix := url.PathEscape(path.Base(upath)) + "/"
+	lines := strings.Split(string(playlist), "\n")
+	for i, line := range lines {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines[i] = prefix + strings.TrimSpace(line)
+		}
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	io.WriteString(w, strings.Join(lines, "\n"))
+}
+
+// run ffmpeg once per source version, returns the directory holding index.m3u8 and the segments
+func segmentVideo(fullpath string, fi os.FileInfo) (string, error) {
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", fullpath, fi.ModTime().UnixNano(), fi.Size())))
+	out := filepath.Join(hlsDir, hex.EncodeToString(key[:8]))
+
+	unlock := lockPath(out)
+	defer unlock()
+
+	if _, err := os.Stat(filepath.Join(out, "index.m3u8")); err == nil {
+		return out, nil
+	}
+
+	// segment into a temp dir renamed when complete, so a failed run is retried
+	tmp := out + ".part"
+	os.RemoveAll(tmp)
+	if err := mkdirAll(tmp); err != nil {
+		return "", err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(ffmpegPath, "-v", "error", "-i", fullpath, "-codec", "copy",
+		"-start_number", "0", "-hls_time", "6", "-hls_list_size", "0",
+		"-hls_segment_filename", filepath.Join(tmp, "seg%05d.ts"), "-f", "hls", filepath.Join(tmp, "index.m3u8"))
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("ffmpeg: %s %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return out, nil
+}
+
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+	URL    string `json:"url"`
+}
+
+// download manifest of all files under the path, text by default or json
+// curl -X GET http://127.0.0.1:2333/manifest/bar
+// curl -X GET "http://127.0.0.1:2333/manifest/bar?format=json"
+func manifest(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	served := servedDir()
+	upath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/manifest"))
+	root := storedPath(filepath.Join(served, filepath.FromSlash(upath)))
+
+	if _, err := os.Stat(root); err != nil {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("%s not found", upath))
+		return
+	}
+
+	// held while hashing too, that is where the io goes
+	release, err := acquireWalk(r.Context())
+	if err != nil {
+		return // the client went away while queued
+	}
+	defer release()
+
+	// collect the files first, so unchanged trees are answered without hashing
+	var fullpaths []string
+	var infos []os.FileInfo
+	var modtime time.Time
+	err = filepath.Walk(root, func(fullpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		// directory mtimes change when files are removed
+		if fi.ModTime().After(modtime) {
+			modtime = fi.ModTime()
+		}
+		// symlinks and other special files are skipped
+		if fi.Mode().IsRegular() {
+			fullpaths = append(fullpaths, fullpath)
+			infos = append(infos, fi)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var total int64
+	for _, fi := range infos {
+		total += fi.Size()
+	}
+	if fresh(w, r, aggregateETag(r, modtime, len(infos), total), modtime) {
+		return
+	}
+
+	srv := requestServer(r)
+	entries := []ManifestEntry{}
+	for i, fullpath := range fullpaths {
+		sum, size, err := fileChecksum(fullpath, infos[i])
+		if err != nil {
+			log.Println("Checksum file error: ", err.Error())
+			continue
+		}
+		rel, _ := filepath.Rel(served, filepath.Join(filepath.Dir(fullpath), servedName(fs.FileInfoToDirEntry(infos[i]))))
+		fpath := "/" + filepath.ToSlash(rel)
+		entries = append(entries, ManifestEntry{Path: fpath, Size: size, Sha256: sum, URL: srv.URL(fpath)})
+	}
+
+	if r.URL.Query().Get("format") == "json" || wantJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+
+	// sha256sum compatible lines followed by size and url
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s  %s  %d  %s\n", e.Sha256, strings.TrimPrefix(e.Path, "/"), e.Size, e.URL)
+	}
+}
+
+// offset of the last n lines of the file
+func lastLines(f *os.File, size int64, n int) (int64, error) {
+	buf := make([]byte, 4096)
+	offset := size
+	lines := 0
+	for offset > 0 {
+		chunk := int64(len(buf))
+		if offset < chunk {
+			chunk = offset
+		}
+		offset -= chunk
+		if _, err := f.ReadAt(buf[:chunk], offset); err != nil {
+			return 0, err
+		}
+		for i := chunk - 1; i >= 0; i-- {
+			// the trailing newline of the file does not start a line
+			if buf[i] == '\n' && offset+i != size-1 {
+				lines++
+				if lines == n {
+					return offset + i + 1, nil
+				}
+			}
+		}
+	}
+	return 0, nil
+}
+
+// last n lines of content that can only be read forwards
+func lastLinesFrom(br *bufio.Reader, n int) ([]string, error) {
+	ring := make([]string, n)
+	count := 0
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" && n > 0 {
+			ring[count%n] = line
+			count++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if count <= n {
+		return ring[:count], nil
+	}
+	return append(ring[count%n:], ring[:count%n]...), nil
+}
+
+// tail text file, follow=true keeps streaming the appended content
+// curl -X GET "http://127.0.0.1:2333/tail/logs/app.log?n=100&follow=true"
+func tail(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	upath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/tail"))
+	fullpath := storedPath(filepath.Join(dir, filepath.FromSlash(upath)))
+
+	n := 10
+	if s := r.URL.Query().Get("n"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 || v > maxTailLines {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("n must be between 0 and %d", maxTailLines))
+			return
+		}
+		n = v
+	}
+	follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+
+	f, err := os.Open(fullpath)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("%s not found", upath))
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("%s is not a file", upath))
+		return
+	}
+
+	// -compressstore files are read forwards through the decompressor and, being
+	// rewritten whole, have nothing to follow
+	if compressStore && strings.HasSuffix(fullpath, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		br := bufio.NewReader(gz)
+		head, _ := br.Peek(512)
+		if !strings.HasPrefix(http.DetectContentType(head), "text/") {
+			writeError(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("%s is not a text file", upath))
+			return
+		}
+		lines, err := lastLinesFrom(br, n)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		for _, line := range lines {
+			io.WriteString(w, line)
+		}
+		return
+	}
+
+	head := make([]byte, 512)
+	m, _ := f.ReadAt(head, 0)
+	if !strings.HasPrefix(http.DetectContentType(head[:m]), "text/") {
+		writeError(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("%s is not a text file", upath))
+		return
+	}
+
+	offset := fi.Size()
+	if n > 0 {
+		if offset, err = lastLines(f, fi.Size(), n); err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		if fi, err := f.Stat(); err == nil {
+			// truncated or rotated in place, start over
+			if fi.Size() < offset {
+				offset = 0
+			}
+			if fi.Size() > offset {
+				f.Seek(offset, io.SeekStart)
+				copied, err := io.CopyN(w, f, fi.Size()-offset)
+				offset += copied
+				if err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+
+		if !follow {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// registered endpoints
+// curl -X GET http://127.0.0.1:2333/routes
+func listRoutes(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routes)
+}
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	writeText(w, "healthy")
+}
+
+// host diagnostics, only served when -auth is set
+// curl -u user:pass http://127.0.0.1:2333/sysinfo
+func sysinfo(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	if authCred == "" {
+		writeError(w, r, http.StatusForbidden, "sysinfo is disabled, start with -auth")
+		return
+	}
+	if !checkAuth(r, authCred) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gofs"`)
+		writeError(w, r, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	info := map[string]interface{}{
+		"hostname":   hostname,
+		"os":         runtime.GOOS,
+		"arch":       runtime.GOARCH,
+		"go":         runtime.Version(),
+		"cpus":       runtime.NumCPU(),
+		"pid":        os.Getpid(),
+		"version":    Version,
+		"started_at": startTime.Format(time.RFC3339),
+	}
+
+	// linux only, left out elsewhere
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil && len(strings.Fields(string(data))) >= 3 {
+		var load []float64
+		for _, f := range strings.Fields(string(data))[:3] {
+			v, _ := strconv.ParseFloat(f, 64)
+			load = append(load, v)
+		}
+		info["load"] = load
+	}
+	if data, err := os.ReadFile("/proc/uptime"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			uptime, _ := strconv.ParseFloat(fields[0], 64)
+			info["uptime"] = uptime
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// escape a label value of the prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func metrics(w http.ResponseWriter, r *http.Request) {
+	// set before writing, the gzip wrapper would otherwise sniff the compressed bytes
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, metricsText())
+}
+
+// metrics in the prometheus text format
+func metricsText() string {
+	metrics := `# HELP gofs_random random number.
+# TYPE gofs_random gauge
+`
+	metrics += fmt.Sprintf("gofs_random{app=\"gofs\"} %d\n", random.Intn(1000))
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	if len(reqSeconds) > 0 {
+		metrics += `
+# HELP gofs_request_seconds seconds the request spent for each path.
+# TYPE gofs_request_seconds counter
+`
+		for k, v := range reqSeconds {
+			metrics += fmt.Sprintf("gofs_request_seconds{app=\"gofs\", path=\"%s\"} %f\n", labelValue(k), v)
+		}
+	}
+
+	if len(reqTimes) > 0 {
+		metrics += `
+# HELP gofs_request_total the request times.
+# TYPE gofs_request_total counter
+`
+		for k, v := range reqTimes {
+			metrics += fmt.Sprintf("gofs_request_total{app=\"gofs\", path=\"%s\"} %d\n", labelValue(k), v)
+		}
+	}
+
+	if len(downloads) > 0 {
+		metrics += `
+# HELP gofs_downloads_total the served file downloads by extension.
+# TYPE gofs_downloads_total counter
+`
+		for k, v := range downloads {
+			metrics += fmt.Sprintf("gofs_downloads_total{app=\"gofs\", ext=\"%s\"} %d\n", labelValue(k), v)
+		}
+	}
+
+	if len(transfers) > 0 {
+		metrics += `
+# HELP gofs_transfer_seconds duration of the uploads and downloads by operation.
+# TYPE gofs_transfer_seconds histogram
+`
+		for _, op := range []string{"upload", "download"} {
+			h := transfers[op]
+			if h == nil {
+				continue
+			}
+			for i, le := range transferBuckets {
+				metrics += fmt.Sprintf("gofs_transfer_seconds_bucket{app=\"gofs\", op=\"%s\", le=\"%g\"} %d\n", op, le, h.Counts[i])
+			}
+			metrics += fmt.Sprintf("gofs_transfer_seconds_bucket{app=\"gofs\", op=\"%s\", le=\"+Inf\"} %d\n", op, h.Count)
+			metrics += fmt.Sprintf("gofs_transfer_seconds_sum{app=\"gofs\", op=\"%s\"} %f\n", op, h.Sum)
+			metrics += fmt.Sprintf("gofs_transfer_seconds_count{app=\"gofs\", op=\"%s\"} %d\n", op, h.Count)
+		}
+	}
+
+	metrics += fmt.Sprintf(`
+# HELP gofs_walks_active directory walks in progress, at most -walkers.
+# TYPE gofs_walks_active gauge
+gofs_walks_active{app="gofs"} %d
+`, atomic.LoadInt64(&walksActive))
+
+	if len(dupNames) > 0 {
+		metrics += `
+# HELP gofs_duplicate_names entries differing only by case in the last listing of each directory.
+# TYPE gofs_duplicate_names gauge
+`
+		for k, v := range dupNames {
+			metrics += fmt.Sprintf("gofs_duplicate_names{app=\"gofs\", dir=\"%s\"} %d\n", labelValue(k), v)
+		}
+	}
+
+	return metrics
+}
+
+// push the metrics to the -pushgateway
+func pushMetrics() {
+	target := strings.TrimSuffix(pushGateway, "/")
+	if !strings.Contains(target, "/metrics/job/") {
+		target += "/metrics/job/gofs"
+	}
+
+	req, err := http.NewRequest("PUT", target, strings.NewReader(metricsText()))
+	if err != nil {
+		log.Println("Push metrics error: ", err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println("Push metrics error: ", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Println("Push metrics error: ", resp.Status)
+	}
+}
+
+// zero the request counters, only with -allowreset and -auth or -metricsauth
+// curl -u user:pass -X POST http://127.0.0.1:2333/metrics/reset
+func resetMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowReset {
+		writeError(w, r, http.StatusForbidden, "metrics reset is disabled, start with -allowreset")
+		return
+	}
+	if authCred == "" && metricsAuth == "" {
+		writeError(w, r, http.StatusForbidden, "metrics reset is disabled, start with -auth or -metricsauth")
+		return
+	}
+	if r.Method != "POST" {
+		writeError(w, r, http.StatusMethodNotAllowed, "requst method must be post")
+		return
+	}
+
+	metricsMu.Lock()
+	reqSeconds = make(map[string]float64)
+	reqTimes = make(map[string]int64)
+	downloads = make(map[string]int64)
+	transfers = make(map[string]*histogram)
+	metricsMu.Unlock()
 
-	b := make([]rune, length)
-	for i := range b {
-		b[i] = lr[rand.Intn(len(lr))]
+	log.Println("Reset metrics successfully")
+	fmt.Fprintf(w, "✔ Succeeded")
+}
+
+var metricsState string
+var metricsSave time.Duration
+
+// on disk form of the -metricsstate counters
+type metricsSnapshot struct {
+	Seconds   map[string]float64    `json:"seconds"`
+	Total     map[string]int64      `json:"total"`
+	Downloads map[string]int64      `json:"downloads"`
+	Transfers map[string]*histogram `json:"transfers"`
+}
+
+// restore the counters saved by saveMetrics, a corrupt state file is
+// reported and ignored, the next snapshot replaces it
+func loadMetrics() {
+	data, err := os.ReadFile(metricsState)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Println("Load metrics error: ", err.Error())
+		return
+	}
+
+	var snap metricsSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		log.Println("Load metrics error: corrupt state file: ", err.Error())
+		return
+	}
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for k, v := range snap.Seconds {
+		if v >= 0 {
+			reqSeconds[k] = v
+		}
+	}
+	for k, v := range snap.Total {
+		if v >= 0 {
+			reqTimes[k] = v
+		}
+	}
+	for k, v := range snap.Downloads {
+		if v >= 0 {
+			downloads[k] = v
+		}
+	}
+	// histograms with other buckets than this version's cannot be merged
+	for k, h := range snap.Transfers {
+		if h != nil && len(h.Counts) == len(transferBuckets) && h.Sum >= 0 {
+			transfers[k] = h
+		}
 	}
+	log.Println(fmt.Sprintf("restored metrics: <%s>", metricsState))
+}
 
-	fmt.Fprintf(w, string(b))
+// snapshot the counters to -metricsstate through a temp file
+func saveMetrics() {
+	metricsMu.Lock()
+	data, err := json.Marshal(metricsSnapshot{Seconds: reqSeconds, Total: reqTimes, Downloads: downloads, Transfers: transfers})
+	metricsMu.Unlock()
+	if err == nil {
+		tmppath := metricsState + ".part"
+		if err = os.WriteFile(tmppath, data, os.FileMode(fileMode)); err == nil {
+			err = os.Rename(tmppath, metricsState)
+		}
+	}
+	if err != nil {
+		log.Println("Save metrics error: ", err.Error())
+	}
 }
 
-func ts(w http.ResponseWriter, r *http.Request) {
-	defer func(t time.Time) {
-		reqTimes[r.URL.Path]++
-		reqSeconds[r.URL.Path] += timeCost(t)
-	}(time.Now())
+var countersMu sync.Mutex
+var counters = make(map[string]uint64)
+var counterFile string
+
+// load the -counterfile state written by saveCounters
+func loadCounters() error {
+	data, err := os.ReadFile(counterFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &counters)
+}
 
-	fmt.Fprintf(w, fmt.Sprintf("%d", time.Now().UnixMilli()))
+// write the counters through a temp file so a crash never leaves a torn file, countersMu must be held
+func saveCounters() error {
+	data, err := json.Marshal(counters)
+	if err != nil {
+		return err
+	}
+	tmppath := counterFile + ".part"
+	if err := os.WriteFile(tmppath, data, os.FileMode(fileMode)); err != nil {
+		return err
+	}
+	return os.Rename(tmppath, counterFile)
 }
 
-func dt(w http.ResponseWriter, r *http.Request) {
-	defer func(t time.Time) {
-		reqTimes[r.URL.Path]++
-		reqSeconds[r.URL.Path] += timeCost(t)
-	}(time.Now())
+// named sequence counters
+// curl http://127.0.0.1:2333/counter/jobs
+// curl -X POST http://127.0.0.1:2333/counter/jobs/reset
+func counter(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/counter"), "/")
+	reset := false
+	if strings.HasSuffix(name, "/reset") {
+		name, reset = strings.TrimSuffix(name, "/reset"), true
+	}
+	if name == "" || strings.Contains(name, "/") {
+		writeError(w, r, http.StatusBadRequest, "usage /counter/<name> or /counter/<name>/reset")
+		return
+	}
+	if reset && r.Method != "POST" {
+		writeError(w, r, http.StatusMethodNotAllowed, "requst method must be post")
+		return
+	}
+
+	countersMu.Lock()
+	if reset {
+		delete(counters, name)
+	} else {
+		counters[name]++
+	}
+	value := counters[name]
+	var err error
+	if counterFile != "" {
+		err = saveCounters()
+	}
+	countersMu.Unlock()
+
+	if err != nil {
+		log.Println("Save counters error: ", err.Error())
+	}
 
-	fmt.Fprintf(w, time.Now().Local().Format("2006-01-02 15:04:05"))
+	if wantJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "value": value})
+		return
+	}
+	writeText(w, strconv.FormatUint(value, 10))
 }
 
-func healthz(w http.ResponseWriter, r *http.Request) {
-	defer func(t time.Time) {
-		reqTimes[r.URL.Path]++
-		reqSeconds[r.URL.Path] += timeCost(t)
-	}(time.Now())
+const maxMotdSize = 4 << 10
+
+var motdMu sync.RWMutex
+var motd string
+var motdFile string
 
-	fmt.Fprintf(w, "healthy")
+func getMotd() string {
+	motdMu.RLock()
+	defer motdMu.RUnlock()
+	return motd
 }
 
-func metrics(w http.ResponseWriter, r *http.Request) {
-	metrics := `# HELP gofs_random random number.
-# TYPE gofs_random gauge
-`
-	metrics += fmt.Sprintf("gofs_random{app=\"gofs\"} %d\n", rand.Intn(1000))
+// message of the day shown on the upload page, anyone can read it, setting it needs -auth
+// curl http://127.0.0.1:2333/motd
+// curl -u user:pass -X POST -d "message=maintenance at 18:00" http://127.0.0.1:2333/motd
+func motdHandler(w http.ResponseWriter, r *http.Request) {
+	defer record(r.URL.Path, time.Now())
 
-	if len(reqSeconds) > 0 {
-		metrics += `
-# HELP gofs_request_seconds seconds the request spent for each path.
-# TYPE gofs_request_seconds counter
-`
-		for k, v := range reqSeconds {
-			metrics += fmt.Sprintf("gofs_request_seconds{app=\"gofs\", path=\"%s\"} %f\n", k, v)
+	if r.Method != "POST" {
+		msg := getMotd()
+		if wantJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"message": msg})
+			return
 		}
+		writeText(w, msg)
+		return
 	}
 
-	if len(reqTimes) > 0 {
-		metrics += `
-# HELP gofs_request_total the request times.
-# TYPE gofs_request_total counter
-`
-		for k, v := range reqTimes {
-			metrics += fmt.Sprintf("gofs_request_total{app=\"gofs\", path=\"%s\"} %d\n", k, v)
+	if authCred == "" {
+		writeError(w, r, http.StatusForbidden, "setting the motd is disabled, start with -auth")
+		return
+	}
+	if !checkAuth(r, authCred) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gofs"`)
+		writeError(w, r, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	fields, err := requestFields(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	msg := strings.TrimSpace(fields["message"])
+	if len(msg) > maxMotdSize {
+		writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("message exceeds %d bytes", maxMotdSize))
+		return
+	}
+
+	motdMu.Lock()
+	motd = msg
+	if motdFile != "" {
+		err = os.WriteFile(motdFile, []byte(msg), os.FileMode(fileMode))
+	}
+	motdMu.Unlock()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Println("Set motd successfully")
+	fmt.Fprintf(w, "✔ Succeeded")
+}
+
+var selfTest bool
+
+// serve the handler on a random local port and exercise the core endpoints,
+// returns the number of failed checks
+// gofs -dir /srv/files -selftest
+func runSelfTest(handler http.Handler) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("✘ listen:", err.Error())
+		return 1
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	base := "http://" + ln.Addr().String()
+	client := &http.Client{Timeout: 30 * time.Second}
+	// the probe takes an extension -allowext and -denyext let through
+	ext := "txt"
+	if !uploadAllowed("probe." + ext) {
+		candidates := []string{"bin", "dat"}
+		if len(allowExts) > 0 {
+			candidates = nil
+			for e := range allowExts {
+				candidates = append(candidates, e)
+			}
+			sort.Strings(candidates)
+		}
+		for _, e := range candidates {
+			if e != "none" && uploadAllowed("probe."+e) {
+				ext = e
+				break
+			}
+		}
+	}
+	name := fmt.Sprintf(".gofs-selftest-%d.%s", time.Now().UnixNano(), ext)
+	// -uploaddir is prepended by the upload handler
+	fpath := path.Join("/", uploadDir, name)
+	content := "gofs selftest " + name
+
+	do := func(method, target, ctype string, body io.Reader, cred string) (int, string, error) {
+		req, err := http.NewRequest(method, base+target, body)
+		if err != nil {
+			return 0, "", err
+		}
+		if ctype != "" {
+			req.Header.Set("Content-Type", ctype)
+		}
+		if u, p, ok := strings.Cut(cred, ":"); ok {
+			req.SetBasicAuth(u, p)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data), err
+	}
+	expect := func(want int) func(int, string, error) error {
+		return func(status int, body string, err error) error {
+			if err != nil {
+				return err
+			}
+			if status != want {
+				return fmt.Errorf("status %d, want %d: %s", status, want, strings.TrimSpace(body))
+			}
+			return nil
 		}
 	}
+	metricsCred := authCred
+	if metricsAuth != "" {
+		metricsCred = metricsAuth
+	}
+
+	// the write checks cannot pass on a read-only server or without dir (-file),
+	// which downloads its file instead of the probe
+	skipWrites, skipDownload := "", ""
+	switch {
+	case singleFile != "":
+		skipWrites = "-file has no upload or delete"
+	case readOnly:
+		skipWrites, skipDownload = "read-only", "read-only, nothing uploaded"
+	}
+
+	checks := []struct {
+		name string
+		skip string
+		run  func() error
+	}{
+		{"upload", skipWrites, func() error {
+			return expect(http.StatusOK)(do("PUT", "/upload/"+name, "text/plain", strings.NewReader(content), authCred))
+		}},
+		{"download", skipDownload, func() error {
+			if singleFile != "" {
+				want, err := os.ReadFile(singleFile)
+				if err != nil {
+					return err
+				}
+				status, body, err := do("GET", "/", "", nil, authCred)
+				if err := expect(http.StatusOK)(status, body, err); err != nil {
+					return err
+				}
+				if body != string(want) {
+					return fmt.Errorf("downloaded %d bytes that differ from %s", len(body), singleFile)
+				}
+				return nil
+			}
+			// -snapshot serves the snapshot, which has no probe, the upload is read back from dir
+			if snapshot {
+				data, err := readStored(filepath.Join(dir, filepath.FromSlash(fpath)))
+				if err != nil {
+					return err
+				}
+				if data != content {
+					return fmt.Errorf("stored %d bytes that differ from the upload", len(data))
+				}
+				return nil
+			}
+			status, body, err := do("GET", fpath, "", nil, authCred)
+			if err := expect(http.StatusOK)(status, body, err); err != nil {
+				return err
+			}
+			if body != content {
+				return fmt.Errorf("downloaded %d bytes that differ from the upload", len(body))
+			}
+			return nil
+		}},
+		{"delete", skipWrites, func() error {
+			form := url.Values{"filepath": {fpath}}.Encode()
+			return expect(http.StatusOK)(do("POST", "/delete", "application/x-www-form-urlencoded", strings.NewReader(form), authCred))
+		}},
+		{"echo", "", func() error {
+			return expect(http.StatusCreated)(do("GET", "/echo/201", "", nil, authCred))
+		}},
+		{"ts", "", func() error {
+			status, body, err := do("GET", "/ts", "", nil, authCred)
+			if err := expect(http.StatusOK)(status, body, err); err != nil {
+				return err
+			}
+			if _, err := strconv.ParseInt(strings.TrimSpace(body), 10, 64); err != nil {
+				return fmt.Errorf("invalid timestamp %q", body)
+			}
+			return nil
+		}},
+		{"metrics", "", func() error {
+			status, body, err := do("GET", "/metrics", "", nil, metricsCred)
+			if err := expect(http.StatusOK)(status, body, err); err != nil {
+				return err
+			}
+			if !strings.Contains(body, "gofs_request_total") {
+				return fmt.Errorf("no gofs_request_total in the metrics")
+			}
+			return nil
+		}},
+	}
 
-	fmt.Fprintf(w, metrics)
+	failed, run := 0, 0
+	for _, check := range checks {
+		if check.skip != "" {
+			fmt.Printf("- %s: skipped, %s\n", check.name, check.skip)
+			continue
+		}
+		run++
+		if err := check.run(); err != nil {
+			failed++
+			fmt.Printf("✘ %s: %s\n", check.name, err.Error())
+		} else {
+			fmt.Printf("✔ %s\n", check.name)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("selftest failed: %d of %d checks\n", failed, run)
+	} else {
+		fmt.Printf("selftest passed: %d checks\n", run)
+	}
+	return failed
 }
 
-func main() {
+// register the command line flags on fs, the globals are reset to their defaults
+func registerFlags(fs *flag.FlagSet) {
+	fileMode, dirMode = octalMode(0644), octalMode(0755)
+	authRules = nil
+
 	// var dport = flag.String("port", "2333", "server port")
 	// var dpath = flag.String("dir", "./", "server path")
-	flag.StringVar(&port, "p", "2333", "server port")
-	flag.StringVar(&port, "port", "2333", "server port")
-	flag.StringVar(&dir, "d", "./", "server path")
-	flag.StringVar(&dir, "dir", "./", "server path")
+	fs.StringVar(&port, "p", "2333", "server port")
+	fs.StringVar(&port, "port", "2333", "server port")
+	fs.StringVar(&dir, "d", "./", "server path")
+	fs.StringVar(&dir, "dir", "./", "server path")
+	fs.StringVar(&singleFile, "file", "", "serve only this file at / instead of browsing dir")
+	fs.StringVar(&serverName, "name", "File Share", "server name shown in page titles and the Server header")
+	fs.IntVar(&gzipLevel, "gziplevel", gzip.DefaultCompression, "gzip compression level, 0-9 or -1 for default")
+	fs.StringVar(&authCred, "auth", "", "basic auth credentials for all requests, user:pass")
+	fs.StringVar(&metricsAuth, "metricsauth", "", "basic auth credentials for /metrics only, user:pass (defaults to -auth)")
+	fs.Var(&authRules, "authrule", "auth rule by path prefix, /prefix=required or /prefix=optional, repeatable (longest prefix wins)")
+	fs.BoolVar(&noSlashRedirect, "noslashredirect", false, "serve directories without redirecting to the trailing slash")
+	fs.BoolVar(&foldCase, "foldcase", false, "match utility paths like /Echo case-insensitively, file paths stay case-sensitive")
+	fs.Var(&fileMode, "filemode", "permission of uploaded files, octal")
+	fs.Var(&dirMode, "dirmode", "permission of created directories, octal")
+	fs.IntVar(&maxConns, "maxconns", 0, "maximum simultaneous connections, excess ones wait (0 means unlimited)")
+	fs.IntVar(&logSample, "logsample", 1, "log only 1 in N successful requests, errors are always logged")
+	fs.BoolVar(&dupWarn, "dupwarn", false, "flag entries differing only by case in directory listings")
+	fs.BoolVar(&precompressed, "precompressed", false, "serve existing .br/.gz sidecar files to clients accepting that encoding")
+	fs.StringVar(&recordDir, "record", "", "dump every request (method, url, headers, body) into files under this directory")
+	fs.Int64Var(&recordMax, "recordmax", 1<<20, "maximum body bytes recorded per request")
+	fs.BoolVar(&autoIndex, "autoindex", false, "generate index.json for directories without one")
+	fs.BoolVar(&readme, "readme", false, "render the README.md of a directory below its html listing")
+	fs.IntVar(&pageSize, "pagesize", 0, "entries per page of the html directory listing (0 disables paging)")
+	fs.StringVar(&scanCmd, "scan", "", "command run against each upload before it is stored, e.g. clamscan (non-zero exit rejects it)")
+	fs.BoolVar(&snapshot, "snapshot", false, "serve downloads from a snapshot of dir taken at startup and on SIGUSR1")
+	fs.StringVar(&snapshotDir, "snapshotdir", os.TempDir(), "directory the snapshots are created in, each one is a full copy of dir")
+	fs.IntVar(&maxDepth, "maxdepth", 0, "maximum number of path components of an upload destination (0 means unlimited)")
+	fs.BoolVar(&compressStore, "compressstore", false, "store uploads gzipped as name.gz and serve them transparently as name")
+	fs.BoolVar(&allowReset, "allowreset", false, "allow POST /metrics/reset to zero the counters, needs -auth or -metricsauth")
+	fs.StringVar(&pushGateway, "pushgateway", "", "prometheus pushgateway url the metrics are pushed to")
+	fs.DurationVar(&pushInterval, "pushinterval", 15*time.Second, "interval of the pushgateway pushes")
+	fs.BoolVar(&quiet404, "quiet404", false, "do not log 404 responses")
+	fs.StringVar(&autocertDomain, "autocert", "", "obtain certificates from let's encrypt for the comma separated domains, serving https on 443")
+	fs.StringVar(&certFile, "cert", "", "serve https with this certificate file (pem), needs -key")
+	fs.StringVar(&keyFile, "key", "", "private key file (pem) of -cert")
+	fs.StringVar(&minTLS, "mintls", "1.2", "minimum tls version for https, 1.2 or 1.3")
+	fs.StringVar(&httpPort, "httpport", "", "also listen for plain http on this port with -cert or -autocert (80 with -autocert)")
+	fs.BoolVar(&httpRedirect, "httpredirect", true, "redirect the -httpport requests to https instead of serving them")
+	fs.StringVar(&certDir, "certdir", filepath.Join(os.TempDir(), "gofs-autocert"), "autocert certificate cache directory")
+	fs.DurationVar(&idempotencyTTL, "idempotencyttl", 10*time.Minute, "how long an upload Idempotency-Key is remembered (0 disables)")
+	fs.Int64Var(&quota, "quota", 0, "bytes each client ip may upload per -quotawindow (0 disables)")
+	fs.DurationVar(&quotaWindow, "quotawindow", time.Hour, "rolling window of the upload -quota")
+	fs.BoolVar(&readOnly, "readonly", false, "only serve files, uploading, deleting and moving are disabled")
+	fs.StringVar(&mirror, "mirror", "", "replicate uploads in the background to another gofs url or a second directory")
+	fs.StringVar(&uploadDir, "uploaddir", "", "confine all uploads to this subdirectory of dir")
+	fs.StringVar(&tmpDir, "tmpdir", "", "stage partial uploads in this directory instead of next to the destination")
+	fs.StringVar(&allowExt, "allowext", "", "comma separated extensions uploads are limited to, none matches names without one")
+	fs.StringVar(&denyExt, "denyext", "", "comma separated extensions rejected on upload, none matches names without one")
+	fs.Int64Var(&seed, "seed", 0, "fixed seed of /uuid, /randint and /randstr for reproducible output, 0 seeds from the clock")
+	fs.StringVar(&emptyMessage, "emptymessage", "This directory is empty.", "shown instead of the listing while the root has no entries, empty shows the bare listing")
+	fs.StringVar(&motdFile, "motdfile", "", "persist the /motd message to this file, relative to dir")
+	fs.IntVar(&walkers, "walkers", 4, "concurrent directory walks of tree, manifest, delete and snapshot (0 is unbounded)")
+	fs.StringVar(&metricsState, "metricsstate", "", "keep the request metrics in this file across restarts, relative to dir")
+	fs.DurationVar(&metricsSave, "metricssave", time.Minute, "how often the -metricsstate snapshot is written")
+	fs.StringVar(&counterFile, "counterfile", "", "persist /counter values to this file, relative to dir")
+	fs.StringVar(&trustProxy, "trustproxy", "", "comma separated proxy CIDRs whose X-Forwarded-For is trusted for the client ip")
+	fs.DurationVar(&slowLog, "slowlog", 0, "only log requests taking longer than this (0 logs all)")
+	fs.StringVar(&logFormat, "logformat", "text", "request log format, text, json or combined (apache/nginx)")
+	fs.IntVar(&logBuffer, "logbuffer", 0, "buffer json/combined access logs in this many bytes and write them to stdout in batches (0 disables)")
+	fs.DurationVar(&logFlush, "logflush", time.Second, "how often the -logbuffer is flushed")
+	fs.StringVar(&chaosDelay, "chaosdelay", "", "delay every request by a duration like 200ms or a range like 100ms-1s (chaos testing)")
+	fs.Float64Var(&chaosError, "chaoserror", 0, "fraction of requests failed with 503, between 0 and 1 (chaos testing)")
+	fs.BoolVar(&hls, "hls", false, "serve hls previews of videos at /hls/<path>.m3u8, segmented by ffmpeg")
+	fs.StringVar(&ffmpegPath, "ffmpeg", "ffmpeg", "ffmpeg binary used by -hls")
+	fs.StringVar(&hlsDir, "hlsdir", filepath.Join(os.TempDir(), "gofs-hls"), "cache directory of the -hls segments")
+	fs.BoolVar(&secure, "secure", false, "send nosniff, frame, referrer and content security policy headers")
+	fs.StringVar(&cspPolicy, "csp", "default-src 'self'; img-src 'self' data:; style-src 'self' 'unsafe-inline'; object-src 'none'; base-uri 'none'", "content security policy sent with -secure")
+	fs.DurationVar(&drainTimeout, "drain", 10*time.Second, "how long in-flight requests may finish on shutdown or a graceful restart (SIGUSR2)")
+	fs.BoolVar(&selfTest, "selftest", false, "serve on a random local port, check upload, download, delete, echo, ts and metrics, then exit")
+	fs.DurationVar(&organizeInterval, "organize", 0, "move files in the root into YYYY/MM/DD folders at this interval (0 disables)")
+}
 
-	flag.Parse()
+// validate the parsed flags and derive the state the handlers use, nothing is started yet
+func prepare() {
+	random = newLockedRand(time.Now().UnixNano())
+	seededRand = newLockedRand(time.Now().UnixNano())
+	if seed != 0 {
+		seededRand = newLockedRand(seed)
+	}
+
+	if walkers < 0 {
+		log.Fatal(fmt.Sprintf("invalid -walkers %d: must not be negative", walkers))
+	}
+	walkSlots = nil
+	if walkers > 0 {
+		walkSlots = make(chan struct{}, walkers)
+	}
+
+	if gzipLevel < gzip.DefaultCompression || gzipLevel > gzip.BestCompression {
+		log.Fatal(fmt.Sprintf("invalid gzip level %d: must be between 0 and 9, or -1 for default", gzipLevel))
+	}
+
+	if nets, err := parseCIDRs(trustProxy); err != nil {
+		log.Fatal(fmt.Sprintf("invalid -trustproxy %q: %s", trustProxy, err.Error()))
+	} else {
+		trustedProxies = nets
+	}
+
+	if logFormat != "text" && logFormat != "json" && logFormat != "combined" {
+		log.Fatal(fmt.Sprintf("invalid -logformat %q: must be text, json or combined", logFormat))
+	}
+
+	if logBuffer > 0 && logFlush <= 0 {
+		log.Fatal("-logflush must be positive")
+	}
+	if logBuffer > 0 && logFormat == "text" {
+		log.Fatal("-logbuffer needs -logformat json or combined, text lines go to the standard log")
+	}
+
+	chaosMin, chaosMax = 0, 0
+	if chaosDelay != "" {
+		var err error
+		if chaosMin, chaosMax, err = parseChaosDelay(chaosDelay); err != nil {
+			log.Fatal(fmt.Sprintf("invalid -chaosdelay %q: %s", chaosDelay, err.Error()))
+		}
+	}
+	if chaosError < 0 || chaosError > 1 {
+		log.Fatal(fmt.Sprintf("invalid -chaoserror %v: must be between 0 and 1", chaosError))
+	}
+
+	for name, cred := range map[string]string{"auth": authCred, "metricsauth": metricsAuth} {
+		if cred != "" && !strings.Contains(cred, ":") {
+			log.Fatal(fmt.Sprintf("invalid -%s %q: must be user:pass", name, cred))
+		}
+	}
+	if authCred == "" && len(authRules) > 0 {
+		log.Fatal("-authrule needs -auth to be set")
+	}
+
+	scanCmd = strings.TrimSpace(scanCmd)
+	allowExts, denyExts = parseExts(allowExt), parseExts(denyExt)
+	if uploadDir != "" {
+		uploadDir = path.Clean("/" + filepath.ToSlash(uploadDir))
+	}
 
-	dir, err := filepath.Abs(dir)
+	var err error
+	dir, err = filepath.Abs(dir)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if motdFile != "" {
+		if !filepath.IsAbs(motdFile) {
+			motdFile = filepath.Join(dir, motdFile)
+		}
+		data, err := os.ReadFile(motdFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		motd = strings.TrimSpace(string(data))
+	}
+
+	if mirror != "" && !strings.HasPrefix(mirror, "http://") && !strings.HasPrefix(mirror, "https://") {
+		if mirror, err = filepath.Abs(mirror); err != nil {
+			log.Fatal(err)
+		}
+		if mirror == dir {
+			log.Fatal("-mirror must not be the served dir")
+		}
+	}
+
+	if hls {
+		if ffmpegPath, err = exec.LookPath(ffmpegPath); err != nil {
+			log.Println("ffmpeg not found, hls previews are disabled: ", err.Error())
+			ffmpegPath = ""
+		}
+	}
+
+	if counterFile != "" {
+		if !filepath.IsAbs(counterFile) {
+			counterFile = filepath.Join(dir, counterFile)
+		}
+		if err := loadCounters(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if metricsState != "" {
+		if !filepath.IsAbs(metricsState) {
+			metricsState = filepath.Join(dir, metricsState)
+		}
+		if metricsSave <= 0 {
+			log.Fatal(fmt.Sprintf("invalid -metricssave %s: must be positive", metricsSave))
+		}
+		loadMetrics()
+	}
+	if pushGateway != "" && pushInterval <= 0 {
+		log.Fatal(fmt.Sprintf("invalid -pushinterval %s: must be positive", pushInterval))
+	}
+
+	if recordDir != "" {
+		if err := mkdirAll(recordDir); err != nil {
+			log.Fatal(err)
+		}
+		log.Println(fmt.Sprintf("record requests: <%s>", recordDir))
+	}
+
+	if tmpDir != "" {
+		if tmpDir, err = filepath.Abs(tmpDir); err != nil {
+			log.Fatal(err)
+		}
+		if err := mkdirAll(tmpDir); err != nil {
+			log.Fatal(err)
+		}
+		log.Println(fmt.Sprintf("upload staging: <%s>", tmpDir))
+	}
+
 	host = GetLocalIP()
+	protocol = "http"
+
+	if autocertDomain != "" {
+		protocol = "https"
+		host = strings.TrimSpace(strings.Split(autocertDomain, ",")[0])
+		port = "443"
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		log.Fatal("-cert and -key must be set together")
+	}
+	if certFile != "" && autocertDomain != "" {
+		log.Fatal("-cert and -autocert cannot be combined")
+	}
+	if certFile != "" {
+		protocol = "https"
+	}
+	if autocertDomain != "" && httpPort == "" {
+		httpPort = "80"
+	}
+	if httpPort != "" && protocol != "https" {
+		log.Fatal("-httpport needs -cert or -autocert")
+	}
+	if httpPort == port {
+		log.Fatal(fmt.Sprintf("-httpport %s must differ from -port", httpPort))
+	}
+	switch minTLS {
+	case "1.2":
+		minTLSVersion = tls.VersionTLS12
+	case "1.3":
+		minTLSVersion = tls.VersionTLS13
+	default:
+		log.Fatal(fmt.Sprintf("invalid -mintls %q: must be 1.2 or 1.3", minTLS))
+	}
+	if protocol == "https" {
+		var names []string
+		for _, id := range cipherSuites {
+			names = append(names, tls.CipherSuiteName(id))
+		}
+		log.Println(fmt.Sprintf("tls: minimum version %s, tls 1.2 cipher suites: %s", minTLS, strings.Join(names, ", ")))
+	}
 
-	http.Handle("/", Gzip(http.FileServer(http.Dir(dir))))
+	if snapshot {
+		if snapshotDir, err = filepath.Abs(snapshotDir); err != nil {
+			log.Fatal(err)
+		}
+		if err := takeSnapshot(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if singleFile != "" {
+		if singleFile, err = filepath.Abs(singleFile); err != nil {
+			log.Fatal(err)
+		}
+		if fi, err := os.Stat(singleFile); err != nil || !fi.Mode().IsRegular() {
+			log.Fatal(fmt.Sprintf("invalid -file %q: must be a regular file", singleFile))
+		}
+		log.Println(fmt.Sprintf("serve file: <%s>", singleFile))
+	}
+}
 
-	http.HandleFunc("/upload", upload)
-	http.HandleFunc("/upload/", upload)
+// the routes behind the middleware chain
+func newHandler() http.Handler {
+	root := Precompressed(Gzip(http.HandlerFunc(files)))
+	if singleFile != "" {
+		root = Gzip(http.HandlerFunc(single))
+	}
 
-	http.HandleFunc("/delete", delete)
-	http.HandleFunc("/delete/", delete)
+	// the random endpoints draw from the source the Server is given
+	srv := serverInfo()
 
-	http.HandleFunc("/delay", delay)
-	http.HandleFunc("/delay/", delay)
+	routes = []Route{
+		{"/", []string{"GET", "HEAD"}, "browse and download files", root},
+		{"/upload", []string{"GET", "POST", "PUT"}, "upload page and file upload", Idempotent(http.HandlerFunc(upload))},
+		{"/uploads", []string{"GET", "POST"}, "in-flight uploads at /uploads/active, POST /uploads/<id>/cancel aborts one (needs -auth)", http.HandlerFunc(uploads)},
+		{"/delete", []string{"POST"}, "delete a file or directory", http.HandlerFunc(remove)},
+		{"/move", []string{"POST"}, "move a file or directory", http.HandlerFunc(move)},
+		{"/delay", []string{"GET"}, "respond after the given delay", http.HandlerFunc(delay)},
+		{"/echo", []string{"GET", "POST", "PUT", "DELETE"}, "echo the request with the given status and headers", http.HandlerFunc(echo)},
+		{"/ip", []string{"GET"}, "server ip", http.HandlerFunc(ip)},
+		{"/uuid", []string{"GET"}, "random uuid", http.HandlerFunc(srv.uuid)},
+		{"/randstr", []string{"GET"}, "random string of the given length", http.HandlerFunc(srv.randstr)},
+		{"/randint", []string{"GET"}, "random integer below the given max", http.HandlerFunc(srv.randint)},
+		{"/ts", []string{"GET"}, "unix timestamp in milliseconds", http.HandlerFunc(ts)},
+		{"/dt", []string{"GET"}, "local date time", http.HandlerFunc(dt)},
+		{"/clockskew", []string{"GET"}, "clock skew against ?client=<unixms>", http.HandlerFunc(clockskew)},
+		{"/tree", []string{"GET"}, "recursive json listing", http.HandlerFunc(tree)},
+		{"/manifest", []string{"GET"}, "file manifest with sizes and sha256", http.HandlerFunc(manifest)},
+		{"/hls", []string{"GET"}, "hls playlist of a video at /hls/<path>.m3u8 (-hls, needs ffmpeg)", http.HandlerFunc(hlsHandler)},
+		{"/url", []string{"GET"}, "full url to fetch /url/<path> from", http.HandlerFunc(urlOf)},
+		{"/verify", []string{"GET"}, "sha256 of a file, ?sha256= tells whether it matches", http.HandlerFunc(verify)},
+		{"/tail", []string{"GET"}, "last lines of a text file, ?n=100&follow=true streams appended lines", http.HandlerFunc(tail)},
+		{"/version", []string{"GET"}, "gofs version", http.HandlerFunc(version)},
+		{"/routes", []string{"GET"}, "registered endpoints", http.HandlerFunc(listRoutes)},
+		{"/healthz", []string{"GET"}, "health check", http.HandlerFunc(healthz)},
+		{"/sysinfo", []string{"GET"}, "host diagnostics (needs -auth)", http.HandlerFunc(sysinfo)},
+		{"/metrics", []string{"GET"}, "prometheus metrics", Gzip(http.HandlerFunc(metrics))},
+		{"/motd", []string{"GET", "POST"}, "message of the day, POST sets it (needs -auth)", http.HandlerFunc(motdHandler)},
+		{"/counter", []string{"GET", "POST"}, "increment /counter/<name>, POST /counter/<name>/reset zeroes it", http.HandlerFunc(counter)},
+		{"/metrics/reset", []string{"POST"}, "zero the request counters (-allowreset)", http.HandlerFunc(resetMetrics)},
+	}
 
-	http.HandleFunc("/echo", echo)
-	http.HandleFunc("/echo/", echo)
+	// -file shares that one file, the routes reading or changing dir are left out
+	if singleFile != "" {
+		dirRoutes := map[string]bool{"/upload": true, "/uploads": true, "/delete": true, "/move": true, "/tree": true,
+			"/manifest": true, "/hls": true, "/url": true, "/verify": true, "/tail": true}
+		kept := routes[:0]
+		for _, route := range routes {
+			if !dirRoutes[route.Path] {
+				kept = append(kept, route)
+			}
+		}
+		routes = kept
+	}
 
-	http.HandleFunc("/ip", ip)
-	http.HandleFunc("/ip/", ip)
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		mux.Handle(route.Path, route.handler)
+		if route.Path != "/" {
+			mux.Handle(route.Path+"/", route.handler)
+		}
+	}
 
-	http.HandleFunc("/uuid", uuid)
-	http.HandleFunc("/uuid/", uuid)
+	return Logger(Normalize(Branding(Secure(Chaos(Recorder(Auth(mux)))))))
+}
 
-	http.HandleFunc("/randstr", randstr)
-	http.HandleFunc("/randstr/", randstr)
+// at most -maxconns connections are served at once, excess ones wait to be accepted
+func limitListener(ln net.Listener) net.Listener {
+	if maxConns > 0 {
+		return netutil.LimitListener(ln, maxConns)
+	}
+	return ln
+}
 
-	http.HandleFunc("/randint", randint)
-	http.HandleFunc("/randint/", randint)
+func main() {
+	registerFlags(flag.CommandLine)
+	flag.Parse()
+	prepare()
 
-	http.HandleFunc("/ts", ts)
-	http.HandleFunc("/ts/", ts)
+	if metricsState != "" {
+		go func() {
+			for range time.Tick(metricsSave) {
+				saveMetrics()
+			}
+		}()
+		shutdownHooks = append(shutdownHooks, saveMetrics)
+	}
 
-	http.HandleFunc("/dt", dt)
-	http.HandleFunc("/dt/", dt)
+	if organizeInterval > 0 {
+		go organize(organizeInterval)
+	}
 
-	http.HandleFunc("/healthz", healthz)
-	http.HandleFunc("/healthz/", healthz)
+	if snapshot {
+		shutdownHooks = append(shutdownHooks, removeSnapshot)
+	}
+	if snapshot && len(snapshotSignals) > 0 {
+		go func() {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, snapshotSignals...)
+			for range c {
+				if err := takeSnapshot(); err != nil {
+					log.Println("Snapshot error: ", err.Error())
+				}
+			}
+		}()
+	}
 
-	http.HandleFunc("/metrics", metrics)
-	http.HandleFunc("/metrics/", metrics)
+	handler := newHandler()
+	if selfTest {
+		if runSelfTest(handler) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	log.Println(fmt.Sprintf("serve path: <%s>", dir))
 	log.Println(fmt.Sprintf("browse url: <0.0.0.0:%s>[%s]", port, host))
 	log.Println(fmt.Sprintf("upload url: <0.0.0.0:%s/upload>[%s]", port, host))
 	// log.Println(fmt.Sprintf("starting file server at folder:<%s> address:<0.0.0.0:%s>", dir, port))
 
-	err = http.ListenAndServe(":"+port, nil)
+	// inherited from the previous process after a graceful restart, by address
+	ln, err := listen(":" + port)
 	if err != nil {
 		log.Fatal(err)
 	}
+	inherited := map[string]net.Listener{":" + port: ln}
+	ln = limitListener(ln)
+
+	srv := &http.Server{Handler: handler}
+
+	// plain http next to https, the acme http-01 challenges of -autocert are answered on it too
+	var m *autocert.Manager
+	if autocertDomain != "" {
+		m = newCertManager(autocertDomain, certDir)
+	}
+	var plainSrv *http.Server
+	var plainLn net.Listener
+	if httpPort != "" {
+		if plainLn, err = listen(":" + httpPort); err != nil {
+			log.Fatal(err)
+		}
+		inherited[":"+httpPort] = plainLn
+		plainSrv = &http.Server{Handler: plainHandler(handler, m)}
+		log.Println(fmt.Sprintf("http url: <0.0.0.0:%s>, redirect to https: %t", httpPort, httpRedirect))
+	}
+
+	// graceful shutdown, in-flight requests get -drain to finish and
+	// the shutdown hooks run once the server stopped
+	drained := make(chan struct{})
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, restartSignals...)...)
+		for sig := range c {
+			if sig != os.Interrupt && sig != syscall.SIGTERM {
+				// graceful restart, the new process accepts on the same sockets while this one drains
+				if err := restart(inherited); err != nil {
+					log.Println("Restart error: ", err.Error())
+					continue
+				}
+				log.Println("restarted, draining")
+			}
+			break
+		}
+		log.Println("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		// both listeners drain concurrently, the hooks wait for the two of them
+		var wg sync.WaitGroup
+		for _, s := range []*http.Server{srv, plainSrv} {
+			if s == nil {
+				continue
+			}
+			wg.Add(1)
+			go func(s *http.Server) {
+				defer wg.Done()
+				s.Shutdown(ctx)
+			}(s)
+		}
+		wg.Wait()
+		close(drained)
+	}()
+
+	if logBuffer > 0 {
+		logSink = &bufferedSink{w: bufio.NewWriterSize(os.Stdout, logBuffer)}
+		go func() {
+			for range time.Tick(logFlush) {
+				logSink.Flush()
+			}
+		}()
+		shutdownHooks = append(shutdownHooks, logSink.Flush)
+	}
+
+	if mirror != "" {
+		go mirrorUploads()
+		// give queued replications the -drain time to finish
+		shutdownHooks = append(shutdownHooks, func() {
+			done := make(chan struct{})
+			go func() {
+				mirrorPending.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(drainTimeout):
+				log.Println("Mirror error: shutting down with replications pending")
+			}
+		})
+	}
+
+	if pushGateway != "" {
+		go func() {
+			for range time.Tick(pushInterval) {
+				pushMetrics()
+			}
+		}()
+		shutdownHooks = append(shutdownHooks, pushMetrics)
+	}
+
+	if plainSrv != nil {
+		go func() {
+			if err := plainSrv.Serve(plainLn); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if m != nil {
+		srv.TLSConfig = secureTLS(m.TLSConfig())
+		err = srv.ServeTLS(ln, "", "")
+	} else if certFile != "" {
+		srv.TLSConfig = secureTLS(&tls.Config{})
+		err = srv.ServeTLS(ln, certFile, keyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Serve returns as soon as Shutdown is called, wait for the drain
+	<-drained
 
+	for _, hook := range shutdownHooks {
+		hook()
+	}
 }
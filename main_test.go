@@ -0,0 +1,3575 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// parse args like gofs <args> would and prepare the handlers, on a fresh temp -dir
+// unless args set one, the state collected by earlier tests is dropped
+func configure(t *testing.T, args ...string) string {
+	t.Helper()
+	root := t.TempDir()
+
+	metricsMu.Lock()
+	reqSeconds = make(map[string]float64)
+	reqTimes = make(map[string]int64)
+	downloads = make(map[string]int64)
+	transfers = make(map[string]*histogram)
+	dupNames = make(map[string]int)
+	metricsMu.Unlock()
+	countersMu.Lock()
+	counters = make(map[string]uint64)
+	countersMu.Unlock()
+	idempotencyMu.Lock()
+	idempotency = make(map[string]*idempotentResult)
+	idempotencyMu.Unlock()
+	quotaMu.Lock()
+	quotaUsage = make(map[string][]*quotaEvent)
+	quotaMu.Unlock()
+	checksumsMu.Lock()
+	checksums = make(map[string]checksum)
+	checksumsMu.Unlock()
+	motd, snapshotPath, logSink, shutdownHooks = "", "", nil, nil
+
+	fs := flag.NewFlagSet("gofs", flag.ContinueOnError)
+	registerFlags(fs)
+	if err := fs.Parse(append([]string{"-dir", root}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	prepare()
+	return dir
+}
+
+// start the routes like gofs <args> would, see configure
+func newTestServer(t *testing.T, args ...string) (*httptest.Server, string) {
+	t.Helper()
+	root := configure(t, args...)
+	srv := httptest.NewServer(newHandler())
+	t.Cleanup(srv.Close)
+	return srv, root
+}
+
+// log output written concurrently by the handlers
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// collect the log output of the test
+func captureLog(t *testing.T) *safeBuffer {
+	buf := &safeBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return buf
+}
+
+func writeFile(t *testing.T, name string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// send the request and return the status, body and headers of the response
+func do(t *testing.T, method, url string, body io.Reader, header ...string) (int, string, http.Header) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data), resp.Header
+}
+
+// names of the json directory listing
+func listNames(t *testing.T, url string) []string {
+	t.Helper()
+	status, body, _ := do(t, "GET", url, nil, "Accept", "application/json")
+	if status != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", url, status, body)
+	}
+	var index struct {
+		Entries []Entry `json:"entries"`
+	}
+	if err := json.Unmarshal([]byte(body), &index); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range index.Entries {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestListingFilters(t *testing.T) {
+	srv, root := newTestServer(t)
+	for _, name := range []string{"a.pdf", "b.TXT", "c.go", "noext"} {
+		writeFile(t, filepath.Join(root, name), name)
+	}
+	os.Mkdir(filepath.Join(root, "sub"), 0755)
+
+	for query, want := range map[string]string{
+		"":                   "a.pdf b.TXT c.go noext sub",
+		"?ext=pdf,txt":       "a.pdf b.TXT sub",
+		"?ext=.go":           "c.go sub",
+		"?type=dir":          "sub",
+		"?type=file":         "a.pdf b.TXT c.go noext",
+		"?type=file&ext=pdf": "a.pdf",
+		"?type=bogus":        "a.pdf b.TXT c.go noext sub",
+	} {
+		if got := strings.Join(listNames(t, srv.URL+"/"+query), " "); got != want {
+			t.Errorf("listing %q = %q, want %q", query, got, want)
+		}
+	}
+
+	_, body, _ := do(t, "GET", srv.URL+"/?ext=pdf", nil)
+	if !strings.Contains(body, "a.pdf") || strings.Contains(body, "c.go") {
+		t.Errorf("html listing ignores the filter: %s", body)
+	}
+}
+
+func TestOrganize(t *testing.T) {
+	_, root := newTestServer(t)
+	day := time.Date(2023, 4, 5, 12, 0, 0, 0, time.Local)
+	for _, name := range []string{"a.txt", "b.log", "c.part"} {
+		writeFile(t, filepath.Join(root, name), name)
+		os.Chtimes(filepath.Join(root, name), day, day)
+	}
+	writeFile(t, filepath.Join(root, "sub", "d.txt"), "d")
+	writeFile(t, filepath.Join(root, "2023", "04", "05", "b.log"), "older")
+
+	organizeOnce()
+
+	for name, want := range map[string]string{
+		"2023/04/05/a.txt": "a.txt",
+		"2023/04/05/b.log": "older", // not overwritten
+		"b.log":            "b.log",
+		"c.part":           "c.part", // still uploading
+		"sub/d.txt":        "d",
+	} {
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("a.txt left in the root: %v", err)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	client := time.Now().Add(-time.Hour).UnixMilli()
+	status, body, _ := do(t, "GET", srv.URL+"/clockskew?client="+strconv.FormatInt(client, 10), nil)
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	var skew map[string]int64
+	if err := json.Unmarshal([]byte(body), &skew); err != nil {
+		t.Fatal(err)
+	}
+	if skew["client"] != client || skew["skew"] != skew["server"]-client {
+		t.Errorf("unexpected skew %v", skew)
+	}
+	if d := time.Duration(skew["skew"]) * time.Millisecond; d < time.Hour || d > time.Hour+time.Minute {
+		t.Errorf("skew %s, want about an hour", d)
+	}
+
+	for _, query := range []string{"", "?client=", "?client=abc", "?client=-5"} {
+		if status, _, _ := do(t, "GET", srv.URL+"/clockskew"+query, nil); status != http.StatusBadRequest {
+			t.Errorf("/clockskew%s: status %d, want 400", query, status)
+		}
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+	// compressible, but not so trivially that every level gives the same size
+	var text strings.Builder
+	r := rand.New(rand.NewSource(1))
+	words := []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta", "eta", "theta"}
+	for text.Len() < 256<<10 {
+		text.WriteString(words[r.Intn(len(words))])
+		text.WriteString(strconv.Itoa(r.Intn(1000)))
+		text.WriteString(" ")
+	}
+
+	sizes := make(map[string]int)
+	for _, level := range []string{"1", "9"} {
+		srv, root := newTestServer(t, "-gziplevel", level)
+		writeFile(t, filepath.Join(root, "words.txt"), text.String())
+
+		status, body, header := do(t, "GET", srv.URL+"/words.txt", nil, "Accept-Encoding", "gzip")
+		if status != http.StatusOK || header.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("level %s: status %d, encoding %q", level, status, header.Get("Content-Encoding"))
+		}
+		gz, err := gzip.NewReader(strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plain, err := io.ReadAll(gz); err != nil || string(plain) != text.String() {
+			t.Fatalf("level %s: body does not decompress to the file: %v", level, err)
+		}
+		sizes[level] = len(body)
+	}
+	if sizes["9"] >= sizes["1"] {
+		t.Errorf("level 9 gave %d bytes, level 1 %d", sizes["9"], sizes["1"])
+	}
+}
+
+func TestConcurrentUploadSamePath(t *testing.T) {
+	srv, root := newTestServer(t)
+
+	const n = 16
+	contents := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		content := strings.Repeat(strconv.Itoa(i)+"-", 20000)
+		contents[content] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status, body, _ := uploadForm(t, srv.URL+"/upload", nil, "same.txt", content); status != http.StatusOK {
+				t.Errorf("status %d: %s", status, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(filepath.Join(root, "same.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contents[string(data)] {
+		t.Errorf("final file of %d bytes is not one of the uploads", len(data))
+	}
+	if matches, _ := filepath.Glob(filepath.Join(root, "*.part")); len(matches) > 0 {
+		t.Errorf("temp files left: %v", matches)
+	}
+}
+
+// post a form to the url
+func postForm(t *testing.T, url string, values url.Values, header ...string) (int, string, http.Header) {
+	t.Helper()
+	return do(t, "POST", url, strings.NewReader(values.Encode()), append([]string{"Content-Type", "application/x-www-form-urlencoded"}, header...)...)
+}
+
+func TestDeleteJSON(t *testing.T) {
+	srv, root := newTestServer(t)
+	writeFile(t, filepath.Join(root, "a.txt"), "a")
+	writeFile(t, filepath.Join(root, "d", "x.txt"), "x")
+	writeFile(t, filepath.Join(root, "d", "e", "y.txt"), "y")
+
+	for _, tc := range []struct {
+		path    string
+		dir     bool
+		removed float64
+	}{
+		{"/a.txt", false, 1},
+		{"/d", true, 4},
+		{"/missing", false, 0},
+	} {
+		status, body, header := postForm(t, srv.URL+"/delete", url.Values{"filepath": {tc.path}}, "Accept", "application/json")
+		if status != http.StatusOK || header.Get("Content-Type") != "application/json" {
+			t.Fatalf("delete %s: status %d, %s", tc.path, status, body)
+		}
+		var result map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result["path"] != tc.path || result["dir"] != tc.dir || result["removed"] != tc.removed {
+			t.Errorf("delete %s = %v", tc.path, result)
+		}
+	}
+	if des, _ := os.ReadDir(root); len(des) != 0 {
+		t.Errorf("%d entries left in the root", len(des))
+	}
+
+	writeFile(t, filepath.Join(root, "b.txt"), "b")
+	if status, body, _ := postForm(t, srv.URL+"/delete", url.Values{"filepath": {"/b.txt"}}); status != http.StatusOK || body != "✔ Succeeded" {
+		t.Errorf("plain delete: status %d, %q", status, body)
+	}
+}
+
+func TestCertManager(t *testing.T) {
+	cache := t.TempDir()
+	m := newCertManager(" example.com, www.example.com ,", cache)
+
+	ctx := context.Background()
+	for _, host := range []string{"example.com", "www.example.com"} {
+		if err := m.HostPolicy(ctx, host); err != nil {
+			t.Errorf("%s rejected: %v", host, err)
+		}
+	}
+	for _, host := range []string{"evil.com", "", "sub.example.com"} {
+		if err := m.HostPolicy(ctx, host); err == nil {
+			t.Errorf("%q accepted", host)
+		}
+	}
+	if m.Cache != autocert.DirCache(cache) {
+		t.Errorf("cache %v, want %s", m.Cache, cache)
+	}
+
+	// the tls-alpn-01 challenge protocol survives the hardening
+	cfg := secureTLS(m.TLSConfig())
+	if cfg.MinVersion != minTLSVersion || cfg.GetCertificate == nil {
+		t.Errorf("tls config not wired: %+v", cfg)
+	}
+	found := false
+	for _, proto := range cfg.NextProtos {
+		found = found || proto == acme.ALPNProto
+	}
+	if !found {
+		t.Errorf("next protos %v lack %s", cfg.NextProtos, acme.ALPNProto)
+	}
+}
+
+// Authorization header value of the user:pass credentials
+func basicAuth(cred string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(cred))
+}
+
+func TestMetricsAuth(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		metrics map[string]int // credentials to the status of /metrics
+		ts      map[string]int
+	}{
+		{nil, map[string]int{"": 200}, map[string]int{"": 200}},
+		{[]string{"-auth", "a:b"}, map[string]int{"": 401, "a:b": 200, "m:n": 401}, map[string]int{"": 401, "a:b": 200}},
+		{[]string{"-metricsauth", "m:n"}, map[string]int{"": 401, "m:n": 200}, map[string]int{"": 200}},
+		{[]string{"-auth", "a:b", "-metricsauth", "m:n"}, map[string]int{"": 401, "a:b": 401, "m:n": 200}, map[string]int{"a:b": 200, "m:n": 401}},
+	} {
+		srv, _ := newTestServer(t, tc.args...)
+		for target, want := range map[string]map[string]int{"/metrics": tc.metrics, "/ts": tc.ts} {
+			for cred, status := range want {
+				var header []string
+				if cred != "" {
+					header = []string{"Authorization", basicAuth(cred)}
+				}
+				if got, _, _ := do(t, "GET", srv.URL+target, nil, header...); got != status {
+					t.Errorf("%v: %s as %q: status %d, want %d", tc.args, target, cred, got, status)
+				}
+			}
+		}
+	}
+}
+
+type treeNode struct {
+	Name     string     `json:"name"`
+	Dir      bool       `json:"dir"`
+	Size     int64      `json:"size"`
+	Children []treeNode `json:"children"`
+}
+
+// compact form of a tree like a(b c(d)), children sorted by name
+func (n treeNode) String() string {
+	s := n.Name
+	if !n.Dir {
+		return s + ":" + strconv.FormatInt(n.Size, 10)
+	}
+	var children []string
+	for _, c := range n.Children {
+		children = append(children, c.String())
+	}
+	sort.Strings(children)
+	return s + "(" + strings.Join(children, " ") + ")"
+}
+
+func TestTree(t *testing.T) {
+	srv, root := newTestServer(t)
+	writeFile(t, filepath.Join(root, "bar", "a.txt"), "aa")
+	writeFile(t, filepath.Join(root, "bar", "sub", "b.txt"), "bbb")
+	writeFile(t, filepath.Join(root, "bar", "sub", "deep", "c.txt"), "c")
+
+	for query, want := range map[string]string{
+		"":         "bar(a.txt:2 sub(b.txt:3 deep(c.txt:1)))",
+		"?depth=1": "bar(a.txt:2 sub())",
+		"?depth=0": "bar()",
+	} {
+		status, body, _ := do(t, "GET", srv.URL+"/tree/bar"+query, nil)
+		if status != http.StatusOK {
+			t.Fatalf("status %d: %s", status, body)
+		}
+		var node treeNode
+		if err := json.Unmarshal([]byte(body), &node); err != nil {
+			t.Fatal(err)
+		}
+		if got := node.String(); got != want {
+			t.Errorf("tree%s = %s, want %s", query, got, want)
+		}
+	}
+
+	if status, _, _ := do(t, "GET", srv.URL+"/tree/bar?depth=-1", nil); status != http.StatusBadRequest {
+		t.Errorf("negative depth: status %d", status)
+	}
+	if status, _, _ := do(t, "GET", srv.URL+"/tree/missing", nil); status != http.StatusNotFound {
+		t.Errorf("missing path: status %d", status)
+	}
+}
+
+func TestQuiet404(t *testing.T) {
+	for _, quiet := range []bool{false, true} {
+		srv, _ := newTestServer(t, "-quiet404="+strconv.FormatBool(quiet))
+		logs := captureLog(t)
+
+		do(t, "GET", srv.URL+"/missing.txt", nil)
+		do(t, "GET", srv.URL+"/echo/500", nil)
+		do(t, "GET", srv.URL+"/echo/400", nil)
+
+		out := logs.String()
+		if !strings.Contains(out, "[ERROR] ") || !strings.Contains(out, "/echo/500 500") {
+			t.Errorf("quiet404=%t: 500 not logged at error level:\n%s", quiet, out)
+		}
+		if !strings.Contains(out, "[WARN] ") || !strings.Contains(out, "/echo/400 400") {
+			t.Errorf("quiet404=%t: 400 not logged at warn level:\n%s", quiet, out)
+		}
+		if logged := strings.Contains(out, "/missing.txt 404"); logged == quiet {
+			t.Errorf("quiet404=%t: 404 logged %t:\n%s", quiet, logged, out)
+		}
+	}
+}
+
+// post a multipart upload of one file with the given form fields
+func uploadForm(t *testing.T, url string, fields map[string]string, filename, content string, header ...string) (int, string, http.Header) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, content)
+	mw.Close()
+	return do(t, "POST", url, &body, append([]string{"Content-Type", mw.FormDataContentType()}, header...)...)
+}
+
+func TestUploadConfirmation(t *testing.T) {
+	srv, root := newTestServer(t)
+
+	status, body, header := uploadForm(t, srv.URL+"/upload", map[string]string{"path": "docs"}, "report <1>.txt", "12345", "Accept", "text/html")
+	if status != http.StatusOK || !strings.HasPrefix(header.Get("Content-Type"), "text/html") {
+		t.Fatalf("status %d, %s", status, body)
+	}
+	for _, want := range []string{"(5 bytes)", "report &lt;1&gt;.txt", "/docs/report%20%3C1%3E.txt"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("confirmation lacks %q:\n%s", want, body)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "docs", "report <1>.txt")); err != nil {
+		t.Error(err)
+	}
+
+	// curl gets plain text
+	if _, body, _ := uploadForm(t, srv.URL+"/upload", nil, "b.txt", "b"); body != "✔ Succeeded" {
+		t.Errorf("plain response %q", body)
+	}
+}
+
+func TestNoSlashRedirect(t *testing.T) {
+	for _, noRedirect := range []bool{false, true} {
+		srv, root := newTestServer(t, "-noslashredirect="+strconv.FormatBool(noRedirect))
+		writeFile(t, filepath.Join(root, "bar", "a.txt"), "a")
+		writeFile(t, filepath.Join(root, "site", "index.html"), "<p>home</p>")
+
+		status, body, header := do(t, "GET", srv.URL+"/bar", nil)
+		if noRedirect {
+			if status != http.StatusOK || !strings.Contains(body, `href="bar/a.txt"`) {
+				t.Errorf("listing without slash: status %d, links relative to the parent expected:\n%s", status, body)
+			}
+		} else if status != http.StatusMovedPermanently || header.Get("Location") != "bar/" {
+			t.Errorf("status %d, location %q, want a redirect to bar/", status, header.Get("Location"))
+		}
+
+		status, body, _ = do(t, "GET", srv.URL+"/site", nil)
+		if noRedirect && (status != http.StatusOK || body != "<p>home</p>") {
+			t.Errorf("index without slash: status %d, %q", status, body)
+		}
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestManifest(t *testing.T) {
+	srv, root := newTestServer(t)
+	files := map[string]string{"/a.txt": "alpha", "/bar/b.bin": strings.Repeat("b", 4096), "/bar/sub/c": ""}
+	for name, content := range files {
+		writeFile(t, filepath.Join(root, filepath.FromSlash(name)), content)
+	}
+
+	status, body, _ := do(t, "GET", srv.URL+"/manifest?format=json", nil)
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	var entries []ManifestEntry
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(files) {
+		t.Fatalf("%d entries, want %d: %s", len(entries), len(files), body)
+	}
+	for _, e := range entries {
+		content, ok := files[e.Path]
+		if !ok || e.Size != int64(len(content)) || e.Sha256 != sha256Hex(content) || !strings.HasSuffix(e.URL, e.Path) {
+			t.Errorf("unexpected entry %+v", e)
+		}
+	}
+
+	// sha256sum compatible text, limited to the subtree
+	_, body, _ = do(t, "GET", srv.URL+"/manifest/bar", nil)
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	sort.Strings(lines)
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], sha256Hex(files["/bar/b.bin"])+"  bar/b.bin  4096  ") {
+		t.Errorf("text manifest:\n%s", body)
+	}
+
+	if status, _, _ := do(t, "GET", srv.URL+"/manifest/missing", nil); status != http.StatusNotFound {
+		t.Errorf("missing subtree: status %d", status)
+	}
+}
+
+func TestManifestCompressStore(t *testing.T) {
+	srv, _ := newTestServer(t, "-compressstore")
+	text := strings.Repeat("0123456789", 100)
+	if status, body, _ := uploadForm(t, srv.URL+"/upload", map[string]string{"path": "bar"}, "notes.txt", text); status != http.StatusOK {
+		t.Fatalf("upload: status %d: %s", status, body)
+	}
+
+	// the served name, size and hash, not those of the stored notes.txt.gz
+	for _, target := range []string{"/manifest?format=json", "/manifest/bar/notes.txt?format=json"} {
+		_, body, _ := do(t, "GET", srv.URL+target, nil)
+		var entries []ManifestEntry
+		if err := json.Unmarshal([]byte(body), &entries); err != nil {
+			t.Fatalf("%s: %v: %s", target, err, body)
+		}
+		if len(entries) != 1 || entries[0].Path != "/bar/notes.txt" || entries[0].Size != int64(len(text)) || entries[0].Sha256 != sha256Hex(text) || !strings.HasSuffix(entries[0].URL, "/bar/notes.txt") {
+			t.Errorf("%s: %+v", target, entries)
+		}
+	}
+
+	// sha256sum -c on a download checks out
+	_, body, _ := do(t, "GET", srv.URL+"/manifest", nil)
+	if !strings.HasPrefix(body, sha256Hex(text)+"  bar/notes.txt  1000  ") {
+		t.Errorf("text manifest:\n%s", body)
+	}
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	srv, root := newTestServer(t)
+	writeFile(t, filepath.Join(root, "a.txt"), "a")
+
+	for _, target := range []string{"/version", "/tree", "/manifest"} {
+		status, _, header := do(t, "GET", srv.URL+target, nil)
+		lastModified := header.Get("Last-Modified")
+		if status != http.StatusOK || lastModified == "" {
+			t.Fatalf("%s: status %d, Last-Modified %q", target, status, lastModified)
+		}
+
+		if status, body, _ := do(t, "GET", srv.URL+target, nil, "If-Modified-Since", lastModified); status != http.StatusNotModified || body != "" {
+			t.Errorf("%s unchanged: status %d, %q", target, status, body)
+		}
+		past := time.Now().Add(-48 * time.Hour).UTC().Format(http.TimeFormat)
+		if status, _, _ := do(t, "GET", srv.URL+target, nil, "If-Modified-Since", past); status != http.StatusOK {
+			t.Errorf("%s modified since: status %d", target, status)
+		}
+	}
+}
+
+func TestUploadModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions")
+	}
+	srv, root := newTestServer(t, "-filemode", "0640", "-dirmode", "0710")
+
+	if status, body, _ := uploadForm(t, srv.URL+"/upload", map[string]string{"path": "new/dir"}, "a.txt", "a"); status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	for name, want := range map[string]os.FileMode{"new": 0710, "new/dir": 0710, "new/dir/a.txt": 0640} {
+		fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != want {
+			t.Errorf("%s mode %o, want %o", name, fi.Mode().Perm(), want)
+		}
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	configure(t, "-maxconns", "2")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: newHandler()}
+	go srv.Serve(limitListener(ln))
+	defer srv.Close()
+
+	// two idle connections hold both slots
+	var held []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		held = append(held, c)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET /ts HTTP/1.1\r\nHost: gofs\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("third connection served while two are held")
+	}
+
+	held[0].Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("queued connection not served once a slot is free: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+func TestLogSample(t *testing.T) {
+	srv, _ := newTestServer(t, "-logsample", "5")
+	logs := captureLog(t)
+
+	for i := 0; i < 100; i++ {
+		do(t, "GET", srv.URL+"/ts", nil)
+	}
+	for i := 0; i < 7; i++ {
+		do(t, "GET", srv.URL+"/echo/500", nil)
+	}
+
+	out := logs.String()
+	if n := strings.Count(out, "GET /ts 200"); n < 15 || n > 25 {
+		t.Errorf("%d of 100 successful requests logged, want about 20", n)
+	}
+	if n := strings.Count(out, "GET /echo/500 500"); n != 7 {
+		t.Errorf("%d of 7 errors logged", n)
+	}
+}
+
+// a sample line of the prometheus text format with properly escaped label values
+var sampleLine = regexp.MustCompile(`^\w+\{app="gofs"(, \w+="(?:[^"\\\n]|\\.)*")*\} [-+0-9.e]+$`)
+
+// fetch /metrics and check every line parses
+func scrape(t *testing.T, url string, header ...string) string {
+	t.Helper()
+	status, body, _ := do(t, "GET", url+"/metrics", nil, header...)
+	if status != http.StatusOK {
+		t.Fatalf("metrics: status %d: %s", status, body)
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") && !sampleLine.MatchString(line) {
+			t.Errorf("malformed metrics line %q", line)
+		}
+	}
+	return body
+}
+
+func TestDuplicateNames(t *testing.T) {
+	srv, root := newTestServer(t, "-dupwarn")
+	writeFile(t, filepath.Join(root, "bar", "File.txt"), "a")
+	writeFile(t, filepath.Join(root, "bar", "file.txt"), "b")
+	writeFile(t, filepath.Join(root, "bar", "other.txt"), "c")
+	if des, _ := os.ReadDir(filepath.Join(root, "bar")); len(des) != 3 {
+		t.Skip("case-insensitive filesystem")
+	}
+
+	_, body, _ := do(t, "GET", srv.URL+"/bar/", nil)
+	if n := strings.Count(body, "differs from another entry only by case"); n != 2 {
+		t.Errorf("%d warnings in the listing, want 2", n)
+	}
+	var index struct{ Entries []Entry }
+	_, body, _ = do(t, "GET", srv.URL+"/bar/", nil, "Accept", "application/json")
+	json.Unmarshal([]byte(body), &index)
+	for _, e := range index.Entries {
+		if e.Dup != (e.Name != "other.txt") {
+			t.Errorf("%s dup %t", e.Name, e.Dup)
+		}
+	}
+	if !strings.Contains(scrape(t, srv.URL), `gofs_duplicate_names{app="gofs", dir="/bar"} 2`) {
+		t.Error("no duplicate metric for /bar")
+	}
+
+	// the raw directory name is escaped in the label
+	if runtime.GOOS != "windows" {
+		weird := "we\"ird\\dir\nx"
+		writeFile(t, filepath.Join(root, weird, "A"), "a")
+		writeFile(t, filepath.Join(root, weird, "a"), "a")
+		do(t, "GET", srv.URL+"/"+url.PathEscape(weird)+"/", nil)
+		if !strings.Contains(scrape(t, srv.URL), `dir="/we\"ird\\dir\nx"} 2`) {
+			t.Error("no escaped duplicate metric")
+		}
+	}
+
+	os.Remove(filepath.Join(root, "bar", "file.txt"))
+	do(t, "GET", srv.URL+"/bar/", nil)
+	if strings.Contains(scrape(t, srv.URL), `dir="/bar"`) {
+		t.Error("duplicate metric kept after the clash was resolved")
+	}
+}
+
+func gzipString(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	io.WriteString(gz, s)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func gunzipString(t *testing.T, s string) string {
+	t.Helper()
+	gz, err := gzip.NewReader(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPrecompressed(t *testing.T) {
+	srv, root := newTestServer(t, "-precompressed")
+	text := strings.Repeat("plain text ", 200)
+	writeFile(t, filepath.Join(root, "a.txt"), text)
+	writeFile(t, filepath.Join(root, "a.txt.gz"), gzipString(t, "from the sidecar"))
+	writeFile(t, filepath.Join(root, "b.txt"), text)
+
+	status, body, header := do(t, "GET", srv.URL+"/a.txt", nil, "Accept-Encoding", "gzip")
+	if status != http.StatusOK || header.Get("Content-Encoding") != "gzip" || gunzipString(t, body) != "from the sidecar" {
+		t.Errorf("sidecar not served: status %d, encoding %q", status, header.Get("Content-Encoding"))
+	}
+	if !strings.HasPrefix(header.Get("Content-Type"), "text/plain") {
+		t.Errorf("sidecar served as %q", header.Get("Content-Type"))
+	}
+
+	_, body, header = do(t, "GET", srv.URL+"/b.txt", nil, "Accept-Encoding", "gzip")
+	if header.Get("Content-Encoding") != "gzip" || gunzipString(t, body) != text {
+		t.Errorf("no on the fly gzip without a sidecar: encoding %q", header.Get("Content-Encoding"))
+	}
+
+	_, body, header = do(t, "GET", srv.URL+"/a.txt", nil, "Accept-Encoding", "identity")
+	if header.Get("Content-Encoding") != "" || body != text {
+		t.Errorf("client without gzip got encoding %q", header.Get("Content-Encoding"))
+	}
+}
+
+func TestRecord(t *testing.T) {
+	rdir := t.TempDir()
+	srv, _ := newTestServer(t, "-record", rdir, "-recordmax", "8")
+	do(t, "POST", srv.URL+"/echo?x=1", strings.NewReader("0123456789abcdef"),
+		"X-Debug", "yes",
+		"Authorization", basicAuth("user:secret"),
+		"Proxy-Authorization", basicAuth("proxy:secret"),
+		"Cookie", "session=secret",
+		"Idempotency-Key", "secret-key")
+
+	files, err := os.ReadDir(rdir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("want one record file, got %d (%v)", len(files), err)
+	}
+	data, err := os.ReadFile(filepath.Join(rdir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := string(data)
+	for _, want := range []string{"POST /echo?x=1 HTTP/1.1\r\n", "X-Debug: yes\r\n", "Authorization: [redacted]\r\n", "Proxy-Authorization: [redacted]\r\n", "Cookie: [redacted]\r\n", "Idempotency-Key: [redacted]\r\n"} {
+		if !strings.Contains(record, want) {
+			t.Errorf("record misses %q:\n%s", want, record)
+		}
+	}
+	if strings.Contains(record, "secret") {
+		t.Errorf("record leaks a credential:\n%s", record)
+	}
+	if !strings.HasSuffix(record, "\r\n\r\n01234567") {
+		t.Errorf("body not capped at 8 bytes:\n%q", record)
+	}
+}
+
+func TestListingNegotiation(t *testing.T) {
+	srv, root := newTestServer(t)
+	writeFile(t, filepath.Join(root, "bar", "a.txt"), "a")
+	writeFile(t, filepath.Join(root, "bar", "sub", "b.txt"), "b")
+
+	status, body, header := do(t, "GET", srv.URL+"/bar/", nil, "Accept", "application/json")
+	if status != http.StatusOK || !strings.HasPrefix(header.Get("Content-Type"), "application/json") {
+		t.Fatalf("json listing: status %d, type %q", status, header.Get("Content-Type"))
+	}
+	var index struct {
+		Path    string  `json:"path"`
+		Entries []Entry `json:"entries"`
+	}
+	if err := json.Unmarshal([]byte(body), &index); err != nil {
+		t.Fatalf("json listing: %v: %s", err, body)
+	}
+	if index.Path != "/bar/" || len(index.Entries) != 2 {
+		t.Errorf("json listing: %+v", index)
+	}
+
+	status, body, header = do(t, "GET", srv.URL+"/bar/", nil, "Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	if status != http.StatusOK || !strings.HasPrefix(header.Get("Content-Type"), "text/html") {
+		t.Fatalf("html listing: status %d, type %q", status, header.Get("Content-Type"))
+	}
+	for _, want := range []string{`<a href="a.txt">a.txt</a>`, `<a href="sub/">sub/</a>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("html listing misses %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestListingLinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows file names cannot contain a colon")
+	}
+	srv, root := newTestServer(t, "-noslashredirect")
+	writeFile(t, filepath.Join(root, "javascript:alert(1)"), "x")
+	writeFile(t, filepath.Join(root, "data:x", "a b.txt"), "x")
+
+	// a colon in the first segment would make the link a url scheme
+	_, body, _ := do(t, "GET", srv.URL+"/", nil)
+	for _, want := range []string{`<a href="./javascript:alert%281%29">`, `<a href="./data:x/">`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("root listing misses %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `href="javascript:`) || strings.Contains(body, `href="data:`) {
+		t.Errorf("root listing links to a scheme:\n%s", body)
+	}
+
+	// without the trailing slash the directory name leads the links
+	_, body, _ = do(t, "GET", srv.URL+"/data:x", nil)
+	if want := `<a href="./data:x/a%20b.txt">`; !strings.Contains(body, want) {
+		t.Errorf("listing misses %s:\n%s", want, body)
+	}
+}
+
+func TestAutoIndex(t *testing.T) {
+	srv, root := newTestServer(t, "-autoindex")
+	writeFile(t, filepath.Join(root, "site", "a.txt"), "hello")
+	writeFile(t, filepath.Join(root, "site", "css", "main.css"), "body{}")
+	writeFile(t, filepath.Join(root, "own", "index.json"), `{"own":true}`)
+
+	for _, u := range []string{"/site/", "/site/index.json"} {
+		header := []string{"Accept", "application/json"}
+		if strings.HasSuffix(u, ".json") {
+			header = nil
+		}
+		status, body, _ := do(t, "GET", srv.URL+u, nil, header...)
+		if status != http.StatusOK {
+			t.Fatalf("GET %s: status %d: %s", u, status, body)
+		}
+		var index map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(body), &index); err != nil {
+			t.Fatalf("GET %s: %v: %s", u, err, body)
+		}
+		var upath string
+		var entries []map[string]interface{}
+		json.Unmarshal(index["path"], &upath)
+		json.Unmarshal(index["entries"], &entries)
+		if upath != "/site/" || len(entries) != 2 {
+			t.Fatalf("GET %s: unexpected index %s", u, body)
+		}
+		for _, e := range entries {
+			for _, key := range []string{"name", "dir", "size", "mtime"} {
+				if _, ok := e[key]; !ok {
+					t.Errorf("GET %s: entry %v misses %q", u, e, key)
+				}
+			}
+		}
+		if entries[0]["name"] != "a.txt" || entries[0]["size"] != float64(5) || entries[1]["name"] != "css" || entries[1]["dir"] != true {
+			t.Errorf("GET %s: unexpected entries %v", u, entries)
+		}
+	}
+
+	if _, body, _ := do(t, "GET", srv.URL+"/own/", nil, "Accept", "application/json"); body != `{"own":true}` {
+		t.Errorf("existing index.json not served: %s", body)
+	}
+}
+
+func TestListingPages(t *testing.T) {
+	srv, root := newTestServer(t, "-pagesize", "10")
+	for i := 0; i < 25; i++ {
+		writeFile(t, filepath.Join(root, "many", fmt.Sprintf("f%02d.txt", i)), "x")
+	}
+	rowRe := regexp.MustCompile(`<a href="f\d\d\.txt">`)
+
+	_, body, _ := do(t, "GET", srv.URL+"/many/?type=file", nil)
+	if n := len(rowRe.FindAllString(body, -1)); n != 10 {
+		t.Errorf("page 1 renders %d entries, want 10", n)
+	}
+	if !strings.Contains(body, "page 1 of 3") || !strings.Contains(body, `<a href="?page=2&amp;type=file">next »</a>`) || strings.Contains(body, "« prev</a>") {
+		t.Errorf("page 1 links:\n%s", body)
+	}
+	if !strings.Contains(body, "f00.txt") || strings.Contains(body, "f10.txt") {
+		t.Errorf("page 1 renders the wrong entries")
+	}
+
+	_, body, _ = do(t, "GET", srv.URL+"/many/?page=3&type=file", nil)
+	if n := len(rowRe.FindAllString(body, -1)); n != 5 {
+		t.Errorf("page 3 renders %d entries, want 5", n)
+	}
+	if !strings.Contains(body, `<a href="?page=2&amp;type=file">« prev</a>`) || strings.Contains(body, "next »</a>") {
+		t.Errorf("page 3 links:\n%s", body)
+	}
+
+	// json is never paged
+	if names := listNames(t, srv.URL+"/many/"); len(names) != 25 {
+		t.Errorf("json listing has %d entries, want 25", len(names))
+	}
+}
+
+func TestScan(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub scanner is a shell script")
+	}
+	script := filepath.Join(t.TempDir(), "scan.sh")
+	writeFile(t, script, "#!/bin/sh\ncase \"$(basename \"$1\")\" in bad|bad.*) echo \"bad: infected\" >&2; exit 1;; esac\n")
+	os.Chmod(script, 0755)
+	srv, root := newTestServer(t, "-scan", script)
+
+	status, body, _ := uploadForm(t, srv.URL+"/upload", nil, "bad", "evil")
+	if status != http.StatusUnprocessableEntity || !strings.Contains(body, "bad: infected") {
+		t.Errorf("bad upload: status %d: %s", status, body)
+	}
+	if files, _ := os.ReadDir(root); len(files) != 0 {
+		t.Errorf("rejected upload left %v behind", files)
+	}
+
+	if status, body, _ := uploadForm(t, srv.URL+"/upload", nil, "good", "fine"); status != http.StatusOK {
+		t.Errorf("good upload: status %d: %s", status, body)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "good")); err != nil || string(data) != "fine" {
+		t.Errorf("good upload not stored: %q %v", data, err)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	srv, _ := newTestServer(t)
+	status, body, header := do(t, "GET", srv.URL+"/routes", nil)
+	if status != http.StatusOK || header.Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, type %q", status, header.Get("Content-Type"))
+	}
+	var list []Route
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	got := map[string]Route{}
+	for _, route := range list {
+		if route.Desc == "" || len(route.Methods) == 0 {
+			t.Errorf("route %s lacks a description or methods", route.Path)
+		}
+		got[route.Path] = route
+	}
+	for p, methods := range map[string]string{
+		"/":        "GET,HEAD",
+		"/upload":  "GET,POST,PUT",
+		"/delete":  "POST",
+		"/echo":    "GET,POST,PUT,DELETE",
+		"/uuid":    "GET",
+		"/routes":  "GET",
+		"/metrics": "GET",
+	} {
+		if route, ok := got[p]; !ok || strings.Join(route.Methods, ",") != methods {
+			t.Errorf("route %s: got %+v, want methods %s", p, route, methods)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	sdir := t.TempDir()
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "a.txt"), "v1")
+	writeFile(t, filepath.Join(root, "sub", "b.txt"), "b1")
+	writeFile(t, filepath.Join(root, "motd.txt"), "m1")
+	srv, _ := newTestServer(t, "-dir", root, "-snapshot", "-snapshotdir", sdir)
+
+	// rewrites replace files like uploads do, new files are not in the snapshot yet
+	writeFile(t, filepath.Join(root, "a.txt.tmp"), "v2")
+	os.Rename(filepath.Join(root, "a.txt.tmp"), filepath.Join(root, "a.txt"))
+	os.Remove(filepath.Join(root, "sub", "b.txt"))
+	writeFile(t, filepath.Join(root, "c.txt"), "new")
+	// written in place like the -motdfile, the snapshot must not share the file
+	if err := os.WriteFile(filepath.Join(root, "motd.txt"), []byte("m2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for p, want := range map[string]string{"/a.txt": "v1", "/sub/b.txt": "b1", "/motd.txt": "m1"} {
+		if status, body, _ := do(t, "GET", srv.URL+p, nil); status != http.StatusOK || body != want {
+			t.Errorf("GET %s: status %d, %q, want the snapshot %q", p, status, body, want)
+		}
+	}
+	if status, _, _ := do(t, "GET", srv.URL+"/c.txt", nil); status != http.StatusNotFound {
+		t.Errorf("file created after the snapshot served with status %d", status)
+	}
+
+	// a new snapshot (SIGUSR1) picks the changes up and drops the old one
+	old := servedDir()
+	if err := takeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("old snapshot %s not removed", old)
+	}
+	if _, body, _ := do(t, "GET", srv.URL+"/a.txt", nil); body != "v2" {
+		t.Errorf("new snapshot serves %q", body)
+	}
+
+	// the shutdown hook leaves nothing behind
+	removeSnapshot()
+	if files, _ := os.ReadDir(sdir); len(files) != 0 {
+		t.Errorf("snapshots left behind: %v", files)
+	}
+}
+
+func TestTail(t *testing.T) {
+	srv, root := newTestServer(t)
+	logfile := filepath.Join(root, "app.log")
+	writeFile(t, logfile, "one\ntwo\nthree\nfour\n")
+	writeFile(t, filepath.Join(root, "blob.bin"), "\x00\x01\x02\x03")
+
+	if _, body, _ := do(t, "GET", srv.URL+"/tail/app.log?n=2", nil); body != "three\nfour\n" {
+		t.Errorf("last 2 lines: %q", body)
+	}
+	if status, _, _ := do(t, "GET", srv.URL+"/tail/blob.bin", nil); status != http.StatusUnsupportedMediaType {
+		t.Errorf("binary file: status %d", status)
+	}
+	if status, _, _ := do(t, "GET", srv.URL+"/tail/..%2f..%2fetc%2fpasswd", nil); status == http.StatusOK {
+		t.Errorf("escaping path: status %d", status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/tail/app.log?n=1&follow=true", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewReader(resp.Body)
+	readLine := func() string {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatalf("follow stream ended: %v", err)
+		}
+		return line
+	}
+	if line := readLine(); line != "four\n" {
+		t.Fatalf("first streamed line %q", line)
+	}
+
+	f, err := os.OpenFile(logfile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("five\nsix\n")
+	f.Close()
+	for _, want := range []string{"five\n", "six\n"} {
+		if line := readLine(); line != want {
+			t.Errorf("streamed %q, want %q", line, want)
+		}
+	}
+}
+
+func TestDownloadsByExt(t *testing.T) {
+	srv, root := newTestServer(t)
+	names := []string{"a.pdf", "b.PDF", "c.jpg", "README", "d.verylongextension123", "e.p-f"}
+	for _, name := range names {
+		writeFile(t, filepath.Join(root, name), "x")
+	}
+	for _, name := range names {
+		if status, _, _ := do(t, "GET", srv.URL+"/"+url.PathEscape(name), nil); status != http.StatusOK {
+			t.Fatalf("GET %s: status %d", name, status)
+		}
+	}
+	// directory listings are not downloads
+	do(t, "GET", srv.URL+"/", nil)
+
+	body := scrape(t, srv.URL)
+	for ext, n := range map[string]int{"pdf": 2, "jpg": 1, "none": 1, "other": 2} {
+		want := fmt.Sprintf(`gofs_downloads_total{app="gofs", ext="%s"} %d`, ext, n)
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+	if n := strings.Count(body, "gofs_downloads_total{"); n != 4 {
+		t.Errorf("%d download series, want 4", n)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	srv, root := newTestServer(t, "-name", "Team <Drop>")
+	writeFile(t, filepath.Join(root, "a.txt"), "a")
+
+	for _, p := range []string{"/", "/upload", "/a.txt", "/missing"} {
+		_, body, header := do(t, "GET", srv.URL+p, nil)
+		if header.Get("Server") != "Team <Drop>" {
+			t.Errorf("GET %s: Server header %q", p, header.Get("Server"))
+		}
+		if (p == "/" || p == "/upload") && !regexp.MustCompile(`<title>.*Team &lt;Drop&gt;</title>`).MatchString(body) {
+			t.Errorf("GET %s: title lacks the name:\n%s", p, body)
+		}
+	}
+}
+
+func TestDeleteMoveJSONBody(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	writeFile(t, filepath.Join(parent, "outside", "keep.txt"), "keep")
+	writeFile(t, filepath.Join(root, "bar", "a.txt"), "a")
+	writeFile(t, filepath.Join(root, "bar", "b.txt"), "b")
+	srv, _ := newTestServer(t, "-dir", root)
+	jsonBody := func(s string) io.Reader { return strings.NewReader(s) }
+
+	status, body, _ := do(t, "POST", srv.URL+"/move", jsonBody(`{"src":"bar/a.txt","dst":"foo/a.txt"}`), "Content-Type", "application/json")
+	if status != http.StatusOK || body != "✔ Succeeded" {
+		t.Errorf("json move: status %d, %q", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(root, "foo", "a.txt")); err != nil {
+		t.Errorf("json move: %v", err)
+	}
+
+	status, body, _ = do(t, "POST", srv.URL+"/delete", jsonBody(`{"filepath":"bar/b.txt"}`), "Content-Type", "application/json", "Accept", "application/json")
+	if status != http.StatusOK || !strings.Contains(body, `"removed":1`) {
+		t.Errorf("json delete: status %d, %s", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(root, "bar", "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("json delete left the file: %v", err)
+	}
+
+	if status, _, _ := do(t, "POST", srv.URL+"/delete", jsonBody(`{"filepath":`), "Content-Type", "application/json"); status != http.StatusBadRequest {
+		t.Errorf("malformed json: status %d", status)
+	}
+
+	// neither the root nor anything outside it can be deleted
+	for _, fpath := range []string{"../outside", "../../outside", "/", ".", "bar/../.."} {
+		status, _, _ := do(t, "POST", srv.URL+"/delete", jsonBody(`{"filepath":"`+fpath+`"}`), "Content-Type", "application/json")
+		if fpath == "../outside" || fpath == "../../outside" {
+			// resolved inside dir, where nothing is named outside
+			if status != http.StatusOK {
+				t.Errorf("delete %s: status %d", fpath, status)
+			}
+		} else if status != http.StatusBadRequest {
+			t.Errorf("delete %s: status %d, want 400", fpath, status)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(parent, "outside", "keep.txt")); err != nil {
+		t.Errorf("delete escaped the root: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "foo", "a.txt")); err != nil {
+		t.Errorf("root deleted: %v", err)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	srv, root := newTestServer(t, "-maxdepth", "2")
+
+	if status, body, _ := uploadForm(t, srv.URL+"/upload", map[string]string{"path": "a"}, "b.txt", "ok"); status != http.StatusOK {
+		t.Errorf("depth 2: status %d: %s", status, body)
+	}
+	if status, body, _ := do(t, "PUT", srv.URL+"/upload/a/c.txt", strings.NewReader("ok")); status != http.StatusOK {
+		t.Errorf("depth 2 put: status %d: %s", status, body)
+	}
+
+	status, body, _ := uploadForm(t, srv.URL+"/upload", map[string]string{"path": "x/y"}, "z.txt", "deep")
+	if status != http.StatusBadRequest || !strings.Contains(body, "maximum depth of 2") {
+		t.Errorf("depth 3: status %d: %s", status, body)
+	}
+	if status, _, _ := do(t, "PUT", srv.URL+"/upload/x/y/z/w.txt", strings.NewReader("deep")); status != http.StatusBadRequest {
+		t.Errorf("depth 4 put: status %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(root, "x")); !os.IsNotExist(err) {
+		t.Errorf("rejected upload created directories: %v", err)
+	}
+}
+
+func TestMetricsGzip(t *testing.T) {
+	srv, _ := newTestServer(t)
+	do(t, "GET", srv.URL+"/ts", nil)
+
+	status, body, header := do(t, "GET", srv.URL+"/metrics", nil, "Accept-Encoding", "gzip")
+	if status != http.StatusOK || header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("status %d, encoding %q", status, header.Get("Content-Encoding"))
+	}
+	if !strings.HasPrefix(header.Get("Content-Type"), "text/plain") {
+		t.Errorf("content type %q", header.Get("Content-Type"))
+	}
+	text := gunzipString(t, body)
+	if !strings.Contains(text, `gofs_request_total{app="gofs", path="/ts"} 1`) {
+		t.Errorf("decoded metrics lack the /ts series:\n%s", text)
+	}
+
+	if _, body, header := do(t, "GET", srv.URL+"/metrics", nil, "Accept-Encoding", "identity"); header.Get("Content-Encoding") != "" || !strings.Contains(body, "gofs_request_total") {
+		t.Errorf("identity scrape: encoding %q", header.Get("Content-Encoding"))
+	}
+}
+
+func TestSingleFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "report.pdf")
+	writeFile(t, file, "%PDF-1.4 single")
+	srv, root := newTestServer(t, "-file", file)
+	writeFile(t, filepath.Join(root, "other.txt"), "not served")
+
+	for _, p := range []string{"/", "/report.pdf"} {
+		status, body, header := do(t, "GET", srv.URL+p, nil)
+		if status != http.StatusOK || body != "%PDF-1.4 single" {
+			t.Errorf("GET %s: status %d, %q", p, status, body)
+		}
+		if header.Get("Content-Type") != "application/pdf" || header.Get("Content-Disposition") != `inline; filename=report.pdf` {
+			t.Errorf("GET %s: type %q, disposition %q", p, header.Get("Content-Type"), header.Get("Content-Disposition"))
+		}
+	}
+	if _, _, header := do(t, "GET", srv.URL+"/?download=1", nil); header.Get("Content-Disposition") != `attachment; filename=report.pdf` {
+		t.Errorf("download disposition %q", header.Get("Content-Disposition"))
+	}
+
+	// no browsing of dir
+	for _, p := range []string{"/other.txt", "/sub/"} {
+		if status, _, _ := do(t, "GET", srv.URL+p, nil); status != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", p, status)
+		}
+	}
+
+	// nor any other route reading or changing dir, the utility routes stay
+	for _, p := range []string{"/manifest", "/tree", "/tail/other.txt", "/verify/other.txt", "/hls/a.mp4.m3u8", "/url/other.txt", "/uploads/active", "/upload", "/upload/x.txt"} {
+		if status, _, _ := do(t, "GET", srv.URL+p, nil); status != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", p, status)
+		}
+	}
+	if status, _, _ := uploadForm(t, srv.URL+"/upload", nil, "x.txt", "x"); status != http.StatusNotFound {
+		t.Errorf("upload: status %d, want 404", status)
+	}
+	for _, p := range []string{"/delete", "/move"} {
+		if status, _, _ := postForm(t, srv.URL+p, url.Values{"filepath": {"other.txt"}, "src": {"other.txt"}, "dst": {"moved.txt"}}); status != http.StatusNotFound {
+			t.Errorf("POST %s: status %d, want 404", p, status)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "other.txt")); err != nil {
+		t.Errorf("other.txt touched: %v", err)
+	}
+	for _, p := range []string{"/ts", "/healthz", "/routes"} {
+		if status, _, _ := do(t, "GET", srv.URL+p, nil); status != http.StatusOK {
+			t.Errorf("GET %s: status %d", p, status)
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	srv, root := newTestServer(t)
+	writeFile(t, filepath.Join(root, "big.bin"), strings.Repeat("x", 4096))
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(root, "big.bin"), mtime, mtime)
+
+	status, body, header := do(t, "HEAD", srv.URL+"/big.bin", nil)
+	if status != http.StatusOK || body != "" {
+		t.Errorf("existing file: status %d, body %q", status, body)
+	}
+	if header.Get("Content-Length") != "4096" || header.Get("Last-Modified") != mtime.Format(http.TimeFormat) {
+		t.Errorf("existing file: length %q, last modified %q", header.Get("Content-Length"), header.Get("Last-Modified"))
+	}
+
+	if status, body, _ := do(t, "HEAD", srv.URL+"/missing.bin", nil); status != http.StatusNotFound || body != "" {
+		t.Errorf("missing file: status %d, body %q", status, body)
+	}
+}
+
+func TestCompressStore(t *testing.T) {
+	srv, root := newTestServer(t, "-compressstore")
+	text := strings.Repeat("0123456789", 100)
+	if status, body, _ := uploadForm(t, srv.URL+"/upload", nil, "notes.txt", text); status != http.StatusOK {
+		t.Fatalf("upload: status %d: %s", status, body)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "notes.txt.gz"))
+	if err != nil || gunzipString(t, string(data)) != text {
+		t.Fatalf("not stored gzipped: %v", err)
+	}
+
+	// gzip clients get the stored file as is
+	_, body, header := do(t, "GET", srv.URL+"/notes.txt", nil, "Accept-Encoding", "gzip")
+	if header.Get("Content-Encoding") != "gzip" || body != string(data) {
+		t.Errorf("gzip client: encoding %q", header.Get("Content-Encoding"))
+	}
+	if !strings.HasPrefix(header.Get("Content-Type"), "text/plain") {
+		t.Errorf("gzip client: type %q", header.Get("Content-Type"))
+	}
+
+	// the others get it decompressed, HEAD and ranges included
+	status, body, header := do(t, "GET", srv.URL+"/notes.txt", nil, "Accept-Encoding", "identity")
+	if status != http.StatusOK || header.Get("Content-Encoding") != "" || body != text {
+		t.Errorf("plain client: status %d, encoding %q", status, header.Get("Content-Encoding"))
+	}
+	status, body, header = do(t, "HEAD", srv.URL+"/notes.txt", nil, "Accept-Encoding", "identity")
+	if status != http.StatusOK || body != "" || header.Get("Content-Length") != strconv.Itoa(len(text)) {
+		t.Errorf("HEAD: status %d, length %q", status, header.Get("Content-Length"))
+	}
+	if status, _, _ := do(t, "HEAD", srv.URL+"/missing.txt", nil, "Accept-Encoding", "identity"); status != http.StatusNotFound {
+		t.Errorf("HEAD missing: status %d", status)
+	}
+	for rng, want := range map[string]string{"bytes=5-9": "56789", "bytes=995-": "56789", "bytes=-3": "789"} {
+		status, body, _ := do(t, "GET", srv.URL+"/notes.txt", nil, "Accept-Encoding", "identity", "Range", rng)
+		if status != http.StatusPartialContent || body != want {
+			t.Errorf("Range %s: status %d, %q", rng, status, body)
+		}
+	}
+
+	// names ending in .gz are stored compressed too and stay distinct
+	archive := gzipString(t, "inner")
+	uploadForm(t, srv.URL+"/upload", nil, "archive.gz", archive)
+	if _, body, _ := do(t, "GET", srv.URL+"/archive.gz", nil, "Accept-Encoding", "identity"); body != archive {
+		t.Errorf("archive.gz not served as uploaded")
+	}
+
+	// listings show the served names
+	names := listNames(t, srv.URL+"/")
+	sort.Strings(names)
+	if strings.Join(names, ",") != "archive.gz,notes.txt" {
+		t.Errorf("listing %v", names)
+	}
+	if _, body, _ := do(t, "GET", srv.URL+"/?format=ndjson&ext=txt", nil); !strings.Contains(body, `"name":"notes.txt"`) || strings.Contains(body, "archive") {
+		t.Errorf("ndjson listing:\n%s", body)
+	}
+
+	// verify, tail and tree resolve them too and see the decompressed content
+	sum := sha256.Sum256([]byte(text))
+	if status, body, _ := do(t, "GET", srv.URL+"/verify/notes.txt?sha256="+hex.EncodeToString(sum[:]), nil); status != http.StatusOK || !strings.Contains(body, `"match":true`) {
+		t.Errorf("verify: status %d: %s", status, body)
+	}
+	uploadForm(t, srv.URL+"/upload", nil, "app.log", "one\ntwo\nthree\n")
+	if status, body, _ := do(t, "GET", srv.URL+"/tail/app.log?n=2", nil); status != http.StatusOK || body != "two\nthree\n" {
+		t.Errorf("tail: status %d, %q", status, body)
+	}
+	if status, body, _ := do(t, "GET", srv.URL+"/tail/app.log?n=0", nil); status != http.StatusOK || body != "" {
+		t.Errorf("tail n=0: status %d, %q", status, body)
+	}
+	if status, _, _ := do(t, "GET", srv.URL+"/tail/archive.gz", nil); status != http.StatusUnsupportedMediaType {
+		t.Errorf("tail of a binary: status %d", status)
+	}
+	if _, body, _ := do(t, "GET", srv.URL+"/tree/", nil); !strings.Contains(body, `"name":"notes.txt"`) || strings.Contains(body, "notes.txt.gz") {
+		t.Errorf("tree:\n%s", body)
+	}
+	if status, body, _ := do(t, "GET", srv.URL+"/tree/notes.txt", nil); status != http.StatusOK || !strings.Contains(body, `"name":"notes.txt"`) {
+		t.Errorf("tree of a file: status %d: %s", status, body)
+	}
+
+	// move and delete resolve the stored names
+	if status, body, _ := postForm(t, srv.URL+"/move", url.Values{"src": {"notes.txt"}, "dst": {"moved/notes.txt"}}); status != http.StatusOK {
+		t.Fatalf("move: status %d: %s", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(root, "moved", "notes.txt.gz")); err != nil {
+		t.Errorf("move: %v", err)
+	}
+	if _, body, _ := do(t, "GET", srv.URL+"/moved/notes.txt", nil, "Accept-Encoding", "identity"); body != text {
+		t.Errorf("moved file not served")
+	}
+	if status, body, _ := postForm(t, srv.URL+"/delete", url.Values{"filepath": {"moved/notes.txt"}}); status != http.StatusOK {
+		t.Errorf("delete: status %d: %s", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(root, "moved", "notes.txt.gz")); !os.IsNotExist(err) {
+		t.Errorf("delete left the stored file: %v", err)
+	}
+}
+
+func TestMetricsReset(t *testing.T) {
+	srv, _ := newTestServer(t, "-allowreset")
+	if status, _, _ := do(t, "POST", srv.URL+"/metrics/reset", nil); status != http.StatusForbidden {
+		t.Errorf("anonymous reset: status %d, want 403", status)
+	}
+
+	for _, args := range [][]string{{"-auth", "user:pass"}, {"-metricsauth", "user:pass"}} {
+		srv, root := newTestServer(t, append([]string{"-allowreset"}, args...)...)
+		writeFile(t, filepath.Join(root, "a.pdf"), "x")
+		cred := "Authorization"
+		do(t, "GET", srv.URL+"/ts", nil, cred, basicAuth("user:pass"))
+		do(t, "GET", srv.URL+"/a.pdf", nil, cred, basicAuth("user:pass"))
+		if body := scrape(t, srv.URL, cred, basicAuth("user:pass")); !strings.Contains(body, `path="/ts"`) || !strings.Contains(body, `ext="pdf"`) {
+			t.Fatalf("%v: counters missing before the reset:\n%s", args, body)
+		}
+
+		if status, _, _ := do(t, "POST", srv.URL+"/metrics/reset", nil); status != http.StatusUnauthorized {
+			t.Errorf("%v: reset without credentials: status %d", args, status)
+		}
+		if status, body, _ := do(t, "POST", srv.URL+"/metrics/reset", nil, cred, basicAuth("user:pass")); status != http.StatusOK {
+			t.Errorf("%v: reset: status %d: %s", args, status, body)
+		}
+		if body := scrape(t, srv.URL, cred, basicAuth("user:pass")); strings.Contains(body, `path="/ts"`) || strings.Contains(body, "gofs_downloads_total{") {
+			t.Errorf("%v: counters survived the reset:\n%s", args, body)
+		}
+	}
+
+	srv, _ = newTestServer(t, "-auth", "user:pass")
+	if status, _, _ := do(t, "POST", srv.URL+"/metrics/reset", nil, "Authorization", basicAuth("user:pass")); status != http.StatusForbidden {
+		t.Errorf("reset without -allowreset: status %d", status)
+	}
+}
+
+func TestPushGateway(t *testing.T) {
+	type push struct {
+		method, path, ctype, body string
+	}
+	pushes := make(chan push, 4)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		pushes <- push{r.Method, r.URL.Path, r.Header.Get("Content-Type"), string(data)}
+	}))
+	defer gateway.Close()
+
+	srv, _ := newTestServer(t, "-pushgateway", gateway.URL)
+	do(t, "GET", srv.URL+"/ts", nil)
+	pushMetrics()
+
+	select {
+	case p := <-pushes:
+		if p.method != "PUT" || p.path != "/metrics/job/gofs" || !strings.HasPrefix(p.ctype, "text/plain") {
+			t.Errorf("push %s %s (%s)", p.method, p.path, p.ctype)
+		}
+		if !strings.Contains(p.body, `gofs_request_total{app="gofs", path="/ts"} 1`) {
+			t.Errorf("pushed payload lacks the /ts counter:\n%s", p.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing pushed")
+	}
+
+	// an explicit job path is kept
+	configure(t, "-pushgateway", gateway.URL+"/metrics/job/files/instance/a")
+	pushMetrics()
+	if p := <-pushes; p.path != "/metrics/job/files/instance/a" {
+		t.Errorf("pushed to %s", p.path)
+	}
+}
+
+func TestUploadURLPath(t *testing.T) {
+	srv, root := newTestServer(t)
+	for _, tc := range []struct {
+		url, filename, want string
+	}{
+		{"/upload/docs/final.txt", "draft.txt", "docs/final.txt"},
+		{"/upload/docs/notes", "notes.txt", "docs/notes"},
+		{"/upload/inbox/", "draft.txt", "inbox/draft.txt"},
+		{"/upload", "plain.txt", "plain.txt"},
+	} {
+		if status, body, _ := uploadForm(t, srv.URL+tc.url, nil, tc.filename, tc.url); status != http.StatusOK {
+			t.Errorf("POST %s: status %d: %s", tc.url, status, body)
+			continue
+		}
+		if data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(tc.want))); err != nil || string(data) != tc.url {
+			t.Errorf("POST %s with %s: not stored at %s: %v", tc.url, tc.filename, tc.want, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "docs", "draft.txt")); !os.IsNotExist(err) {
+		t.Errorf("multipart filename used despite the url path: %v", err)
+	}
+
+	if status, body, _ := do(t, "PUT", srv.URL+"/upload/put/raw.bin", strings.NewReader("raw")); status != http.StatusOK {
+		t.Errorf("PUT: status %d: %s", status, body)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "put", "raw.bin")); string(data) != "raw" {
+		t.Errorf("PUT stored %q", data)
+	}
+}
+
+func TestAuthRules(t *testing.T) {
+	srv, root := newTestServer(t, "-auth", "user:pass", "-authrule", "/public=optional", "-authrule", "/public/private=required")
+	writeFile(t, filepath.Join(root, "public", "a.txt"), "open")
+	writeFile(t, filepath.Join(root, "public", "private", "b.txt"), "closed")
+	writeFile(t, filepath.Join(root, "c.txt"), "closed")
+	cred := []string{"Authorization", basicAuth("user:pass")}
+
+	for p, want := range map[string]int{"/public/a.txt": 200, "/public/": 200, "/public/private/b.txt": 401, "/c.txt": 401, "/publicity": 401} {
+		status, _, header := do(t, "GET", srv.URL+p, nil)
+		if status != want {
+			t.Errorf("anonymous GET %s: status %d, want %d", p, status, want)
+		}
+		if status == http.StatusUnauthorized && header.Get("WWW-Authenticate") == "" {
+			t.Errorf("anonymous GET %s: no challenge", p)
+		}
+		if status, _, _ := do(t, "GET", srv.URL+p, nil, cred...); status == http.StatusUnauthorized {
+			t.Errorf("authenticated GET %s: status %d", p, status)
+		}
+	}
+
+	// an open prefix neither overrides -metricsauth nor opens up the reset
+	for _, tc := range []struct {
+		args   []string
+		openTS bool
+	}{
+		{[]string{"-metricsauth", "m:n", "-authrule", "/=optional"}, true},
+		{[]string{"-metricsauth", "m:n", "-authrule", "/metrics=optional"}, false},
+		{[]string{"-authrule", "/=optional"}, true},
+	} {
+		srv, _ := newTestServer(t, append([]string{"-auth", "user:pass", "-allowreset"}, tc.args...)...)
+		if tc.args[0] == "-metricsauth" {
+			if status, _, _ := do(t, "GET", srv.URL+"/metrics", nil); status != http.StatusUnauthorized {
+				t.Errorf("%v: anonymous /metrics: status %d", tc.args, status)
+			}
+		}
+		if status, _, _ := do(t, "POST", srv.URL+"/metrics/reset", nil); status != http.StatusUnauthorized {
+			t.Errorf("%v: anonymous reset: status %d", tc.args, status)
+		}
+		if status, _, _ := do(t, "GET", srv.URL+"/ts", nil); (status == http.StatusOK) != tc.openTS {
+			t.Errorf("%v: anonymous /ts: status %d", tc.args, status)
+		}
+	}
+}
+
+func TestEchoCompressedBody(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	_, body, _ := do(t, "POST", srv.URL+"/echo", strings.NewReader(gzipString(t, "hello gzip")), "Content-Encoding", "gzip")
+	if !strings.HasSuffix(body, "\nhello gzip\n") {
+		t.Errorf("gzip body not echoed decompressed:\n%s", body)
+	}
+
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	io.WriteString(zw, "hello deflate")
+	zw.Close()
+	if _, body, _ := do(t, "POST", srv.URL+"/echo", &deflated, "Content-Encoding", "deflate"); !strings.HasSuffix(body, "\nhello deflate\n") {
+		t.Errorf("deflate body not echoed decompressed:\n%s", body)
+	}
+
+	if status, _, _ := do(t, "POST", srv.URL+"/echo", strings.NewReader("not gzip"), "Content-Encoding", "gzip"); status != http.StatusBadRequest {
+		t.Errorf("corrupt gzip: status %d", status)
+	}
+	if status, _, _ := do(t, "POST", srv.URL+"/echo", strings.NewReader("x"), "Content-Encoding", "br"); status != http.StatusUnsupportedMediaType {
+		t.Errorf("unsupported encoding: status %d", status)
+	}
+	bomb := gzipString(t, strings.Repeat("\x00", maxBodySize+1))
+	if status, _, _ := do(t, "POST", srv.URL+"/echo", strings.NewReader(bomb), "Content-Encoding", "gzip"); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("body over the cap: status %d", status)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	srv, root := newTestServer(t, "-counterfile", "counters.json")
+
+	const n = 50
+	values := make(chan int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, body, _ := do(t, "GET", srv.URL+"/counter/jobs", nil)
+			v, _ := strconv.Atoi(body)
+			values <- v
+		}()
+	}
+	wg.Wait()
+	close(values)
+	seen := make(map[int]bool)
+	for v := range values {
+		if v < 1 || v > n || seen[v] {
+			t.Errorf("duplicate or out of range value %d", v)
+		}
+		seen[v] = true
+	}
+	if _, body, _ := do(t, "GET", srv.URL+"/counter/jobs", nil, "Accept", "application/json"); body != `{"name":"jobs","value":51}`+"\n" {
+		t.Errorf("final value %s", body)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "counters.json"))
+	if err != nil || !strings.Contains(string(data), `"jobs":51`) {
+		t.Errorf("counters not persisted: %s %v", data, err)
+	}
+
+	// the sweeper leaves the state file in place
+	organizeOnce()
+	if _, err := os.Stat(filepath.Join(root, "counters.json")); err != nil {
+		t.Errorf("organize moved the counter file: %v", err)
+	}
+
+	if status, _, _ := do(t, "GET", srv.URL+"/counter/jobs/reset", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET reset: status %d", status)
+	}
+	if _, body, _ := do(t, "POST", srv.URL+"/counter/jobs/reset", nil); body != "0" {
+		t.Errorf("reset returned %q", body)
+	}
+	if _, body, _ := do(t, "GET", srv.URL+"/counter/jobs", nil); body != "1" {
+		t.Errorf("after the reset %q", body)
+	}
+
+	// restored on restart
+	do(t, "GET", srv.URL+"/counter/jobs", nil)
+	srv, _ = newTestServer(t, "-dir", root, "-counterfile", "counters.json")
+	if _, body, _ := do(t, "GET", srv.URL+"/counter/jobs", nil); body != "3" {
+		t.Errorf("after a restart %q", body)
+	}
+}
+
+func TestReadme(t *testing.T) {
+	readme := "# Project Title\n\nSome *notes* here.\n\n<script>alert(1)</script>\n\n[click](javascript:alert(2))\n"
+	srv, root := newTestServer(t, "-readme")
+	writeFile(t, filepath.Join(root, "proj", "README.md"), readme)
+	writeFile(t, filepath.Join(root, "proj", "a.txt"), "a")
+
+	_, body, _ := do(t, "GET", srv.URL+"/proj/", nil)
+	for _, want := range []string{"<h1>Project Title</h1>", "<em>notes</em>", `<a href="a.txt">a.txt</a>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing lacks %s:\n%s", want, body)
+		}
+	}
+	for _, unsafe := range []string{"<script>alert(1)", "javascript:"} {
+		if strings.Contains(body, unsafe) {
+			t.Errorf("listing contains %s:\n%s", unsafe, body)
+		}
+	}
+
+	srv, _ = newTestServer(t, "-dir", root)
+	if _, body, _ := do(t, "GET", srv.URL+"/proj/", nil); strings.Contains(body, "<h1>Project Title</h1>") {
+		t.Errorf("readme rendered without -readme")
+	}
+}
+
+func TestUploadExts(t *testing.T) {
+	srv, root := newTestServer(t, "-allowext", "png,none", "-denyext", "exe")
+	for _, tc := range []struct {
+		name   string
+		status int
+	}{
+		{"cat.png", 200},
+		{"CAT.PNG", 200},
+		{"Makefile", 200},
+		{"setup.exe", 415},
+		{"notes.txt", 415},
+	} {
+		status, body, _ := uploadForm(t, srv.URL+"/upload", nil, tc.name, "x")
+		if status != tc.status {
+			t.Errorf("upload %s: status %d, want %d: %s", tc.name, status, tc.status, body)
+		}
+		if _, err := os.Stat(filepath.Join(root, tc.name)); (err == nil) != (tc.status == 200) {
+			t.Errorf("upload %s: stored %v", tc.name, err == nil)
+		}
+	}
+	if status, _, _ := do(t, "PUT", srv.URL+"/upload/bin/tool.Exe", strings.NewReader("x")); status != http.StatusUnsupportedMediaType {
+		t.Errorf("PUT tool.Exe: status %d", status)
+	}
+
+	// without none in the allow list extensionless names are rejected
+	srv, _ = newTestServer(t, "-allowext", ".png")
+	if status, _, _ := uploadForm(t, srv.URL+"/upload", nil, "Makefile", "x"); status != http.StatusUnsupportedMediaType {
+		t.Errorf("extensionless upload: status %d", status)
+	}
+	if status, _, _ := uploadForm(t, srv.URL+"/upload", nil, "a.png", "x"); status != http.StatusOK {
+		t.Errorf("png upload: status %d", status)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	srv, _ := newTestServer(t)
+	for _, tc := range []struct {
+		accept, ctype, body string
+	}{
+		{"application/json", "application/json", `{"error":"requst method must be post","status":405}` + "\n"},
+		{"text/html,*/*", "text/html; charset=utf-8", "<p>✘ Failed: requst method must be post</p>"},
+		{"", "text/plain; charset=utf-8", "✘ Failed: requst method must be post"},
+	} {
+		status, body, header := do(t, "GET", srv.URL+"/delete", nil, "Accept", tc.accept)
+		if status != http.StatusMethodNotAllowed || header.Get("Content-Type") != tc.ctype || !strings.Contains(body, tc.body) {
+			t.Errorf("Accept %q: status %d, type %q, body %q", tc.accept, status, header.Get("Content-Type"), body)
+		}
+		if header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("Accept %q: no nosniff", tc.accept)
+		}
+	}
+
+	// errors behind the Gzip wrapper are compressed and say so
+	failing := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br") // meant for a body that is not sent
+		writeError(w, r, http.StatusInternalServerError, "boom")
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	Gzip(http.HandlerFunc(failing)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Encoding") != "gzip" || gunzipString(t, rec.Body.String()) != "✘ Failed: boom" {
+		t.Errorf("gzip wrapped error: status %d, encoding %q", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+	rec = httptest.NewRecorder()
+	http.HandlerFunc(failing).ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "✘ Failed: boom" {
+		t.Errorf("plain error: encoding %q, body %q", rec.Header().Get("Content-Encoding"), rec.Body.String())
+	}
+
+	// failures of the utility endpoints go through it too
+	if status, body, _ := do(t, "GET", srv.URL+"/delay/soon", nil, "Accept", "application/json"); status != http.StatusBadRequest || !strings.Contains(body, `"status":400`) {
+		t.Errorf("bad delay: status %d, %s", status, body)
+	}
+	if status, body, _ := do(t, "GET", srv.URL+"/delay/10ms", nil); status != http.StatusOK || !strings.HasPrefix(body, "(10ms later)") {
+		t.Errorf("delay: status %d, %q", status, body)
+	}
+}
+
+// body that sets the request trailer once it is fully read
+type trailerBody struct {
+	io.Reader
+	req *http.Request
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.req.Trailer.Set("X-Checksum", "abc123")
+	}
+	return n, err
+}
+
+func TestEchoTrailers(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	req, _ := http.NewRequest("POST", srv.URL+"/echo?trailer=Grpc-Status=0,Grpc-Message=ok", nil)
+	req.Body = io.NopCloser(&trailerBody{Reader: strings.NewReader("chunked body"), req: req})
+	req.ContentLength = -1
+	req.Trailer = http.Header{"X-Checksum": nil}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	body := string(data)
+
+	if !strings.Contains(body, ">>> Trailer X-Checksum: abc123\n") {
+		t.Errorf("request trailer not echoed:\n%s", body)
+	}
+	if !strings.Contains(body, "\nchunked body\n") {
+		t.Errorf("body not echoed:\n%s", body)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "ok" {
+		t.Errorf("response trailers %v", resp.Trailer)
+	}
+}
+
+func TestParseChaosDelay(t *testing.T) {
+	for in, want := range map[string][2]time.Duration{
+		"200ms":     {200 * time.Millisecond, 200 * time.Millisecond},
+		"100ms-1s":  {100 * time.Millisecond, time.Second},
+		" 1s - 2s ": {time.Second, 2 * time.Second},
+	} {
+		min, max, err := parseChaosDelay(in)
+		if err != nil || min != want[0] || max != want[1] {
+			t.Errorf("parseChaosDelay(%q) = %v, %v, %v", in, min, max, err)
+		}
+	}
+	for _, in := range []string{"soon", "2s-1s", "-1s"} {
+		if _, _, err := parseChaosDelay(in); err == nil {
+			t.Errorf("parseChaosDelay(%q) accepted", in)
+		}
+	}
+}
+
+func TestChaos(t *testing.T) {
+	srv, _ := newTestServer(t, "-chaosdelay", "20ms-60ms")
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		do(t, "GET", srv.URL+"/ts", nil)
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > time.Second {
+			t.Errorf("request took %v, want 20ms-60ms plus overhead", elapsed)
+		}
+	}
+
+	srv, _ = newTestServer(t, "-chaoserror", "0.3", "-seed", "1")
+	failed := 0
+	const n = 400
+	for i := 0; i < n; i++ {
+		status, body, _ := do(t, "GET", srv.URL+"/ts", nil)
+		if status == http.StatusServiceUnavailable {
+			failed++
+			if !strings.Contains(body, "injected chaos error") {
+				t.Errorf("503 body %q", body)
+			}
+		}
+	}
+	if rate := float64(failed) / n; rate < 0.2 || rate > 0.4 {
+		t.Errorf("error rate %.2f, want about 0.3", rate)
+	}
+
+	srv, _ = newTestServer(t)
+	for i := 0; i < 50; i++ {
+		if status, _, _ := do(t, "GET", srv.URL+"/ts", nil); status != http.StatusOK {
+			t.Fatalf("chaos off: status %d", status)
+		}
+	}
+}
+
+func TestCombinedLog(t *testing.T) {
+	srv, _ := newTestServer(t, "-logformat", "combined", "-auth", "alice:pw")
+	logs := captureLog(t)
+
+	do(t, "GET", srv.URL+"/echo/201?a=1", nil, "Authorization", basicAuth("alice:pw"), "Referer", "http://ref.example/", "User-Agent", `tester "1.0"`)
+	do(t, "GET", srv.URL+"/ts", nil, "User-Agent", "")
+
+	// the access lines, apart from the timestamped log of the error
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if !regexp.MustCompile(`^\d{4}/\d\d/\d\d `).MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 2 {
+		t.Fatalf("%d access lines:\n%s", len(lines), logs.String())
+	}
+	first := regexp.MustCompile(`^127\.0\.0\.1 - alice \[\d\d/[A-Z][a-z]{2}/\d{4}:\d\d:\d\d:\d\d [-+]\d{4}\] "GET /echo/201\?a=1 HTTP/1\.1" 201 \d+ "http://ref\.example/" "tester \\"1\.0\\""$`)
+	if !first.MatchString(lines[0]) {
+		t.Errorf("combined line %q", lines[0])
+	}
+	second := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^]]+\] "GET /ts HTTP/1\.1" 401 \d+ "-" "-"$`)
+	if !second.MatchString(lines[1]) {
+		t.Errorf("combined line %q", lines[1])
+	}
+}
+
+func TestSysinfo(t *testing.T) {
+	srv, _ := newTestServer(t)
+	if status, _, _ := do(t, "GET", srv.URL+"/sysinfo", nil); status != http.StatusForbidden {
+		t.Errorf("without -auth: status %d", status)
+	}
+
+	srv, _ = newTestServer(t, "-auth", "user:pass")
+	if status, _, _ := do(t, "GET", srv.URL+"/sysinfo", nil); status != http.StatusUnauthorized {
+		t.Errorf("anonymous: status %d", status)
+	}
+	status, body, _ := do(t, "GET", srv.URL+"/sysinfo", nil, "Authorization", basicAuth("user:pass"))
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	var info map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	want := []string{"hostname", "os", "arch", "go", "cpus", "pid", "version", "started_at"}
+	if runtime.GOOS == "linux" {
+		want = append(want, "load", "uptime")
+	}
+	for _, key := range want {
+		if _, ok := info[key]; !ok {
+			t.Errorf("sysinfo lacks %q: %s", key, body)
+		}
+	}
+	if info["os"] != runtime.GOOS || info["pid"] != float64(os.Getpid()) || info["cpus"] != float64(runtime.NumCPU()) {
+		t.Errorf("sysinfo %s", body)
+	}
+}
+
+func TestUploadDir(t *testing.T) {
+	srv, root := newTestServer(t, "-uploaddir", "incoming")
+	writeFile(t, filepath.Join(root, "public", "a.txt"), "browse")
+
+	if status, body, _ := uploadForm(t, srv.URL+"/upload", map[string]string{"path": "foo"}, "a.txt", "x"); status != http.StatusOK {
+		t.Fatalf("upload: status %d: %s", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(root, "incoming", "foo", "a.txt")); err != nil {
+		t.Errorf("upload not under incoming/foo: %v", err)
+	}
+
+	for _, target := range []string{"../../escape", "/etc", "../public"} {
+		uploadForm(t, srv.URL+"/upload", map[string]string{"path": target}, "e.txt", "x")
+	}
+	do(t, "PUT", srv.URL+"/upload/../../put.txt", strings.NewReader("x"))
+	for _, name := range []string{
+		filepath.Join(root, "..", "escape", "e.txt"),
+		filepath.Join(root, "public", "e.txt"),
+		filepath.Join(root, "put.txt"),
+	} {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("upload escaped to %s", name)
+		}
+	}
+	for _, name := range []string{"escape/e.txt", "etc/e.txt", "public/e.txt"} {
+		if _, err := os.Stat(filepath.Join(root, "incoming", filepath.FromSlash(name))); err != nil {
+			t.Errorf("confined upload missing: %v", err)
+		}
+	}
+
+	// browsing is not confined
+	if _, body, _ := do(t, "GET", srv.URL+"/public/a.txt", nil); body != "browse" {
+		t.Errorf("browse %q", body)
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	srv, _ := newTestServer(t)
+	for _, p := range []string{"/uuid", "/ip", "/ts", "/dt", "/randstr/12", "/randint/10", "/healthz", "/version"} {
+		status, body, header := do(t, "GET", srv.URL+p, nil, "Accept-Encoding", "identity")
+		if status != http.StatusOK || header.Get("Content-Length") != strconv.Itoa(len(body)) {
+			t.Errorf("GET %s: status %d, Content-Length %q for %d bytes", p, status, header.Get("Content-Length"), len(body))
+		}
+	}
+	_, body, _ := do(t, "GET", srv.URL+"/uuid", nil)
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`).MatchString(body) {
+		t.Errorf("uuid %q", body)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	srv, root := newTestServer(t)
+	name := filepath.Join(root, "a.txt")
+
+	status, body, _ := do(t, "PUT", srv.URL+"/upload/a.txt", strings.NewReader("first"), "Idempotency-Key", "k1")
+	if status != http.StatusOK {
+		t.Fatalf("first: status %d: %s", status, body)
+	}
+	os.Remove(name)
+	status, replay, header := do(t, "PUT", srv.URL+"/upload/a.txt", strings.NewReader("second"), "Idempotency-Key", "k1")
+	if status != http.StatusOK || replay != body || header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry: status %d, %q, replayed %q", status, replay, header.Get("Idempotent-Replayed"))
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("retry stored the file again: %v", err)
+	}
+
+	// reused for another request
+	if status, _, _ := do(t, "PUT", srv.URL+"/upload/b.txt", strings.NewReader("b"), "Idempotency-Key", "k1"); status != http.StatusUnprocessableEntity {
+		t.Errorf("key reused for another path: status %d", status)
+	}
+	if status, _, _ := do(t, "POST", srv.URL+"/upload/a.txt", strings.NewReader("b"), "Idempotency-Key", "k1"); status != http.StatusUnprocessableEntity {
+		t.Errorf("key reused for another method: status %d", status)
+	}
+
+	// another client's key of the same value is its own
+	status, _, header = do(t, "PUT", srv.URL+"/upload/a.txt", strings.NewReader("other"), "Idempotency-Key", "k1", "Authorization", basicAuth("bob:pw"))
+	if status != http.StatusOK || header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("other client: status %d, replayed %q", status, header.Get("Idempotent-Replayed"))
+	}
+	if data, _ := os.ReadFile(name); string(data) != "other" {
+		t.Errorf("other client's upload not stored: %q", data)
+	}
+
+	// failures are not remembered
+	srv, _ = newTestServer(t, "-denyext", "exe")
+	if status, _, _ := do(t, "PUT", srv.URL+"/upload/x.exe", strings.NewReader("x"), "Idempotency-Key", "k2"); status != http.StatusUnsupportedMediaType {
+		t.Fatalf("denied upload: status %d", status)
+	}
+	if status, _, header := do(t, "PUT", srv.URL+"/upload/x.exe", strings.NewReader("x"), "Idempotency-Key", "k2"); status != http.StatusUnsupportedMediaType || header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("retried failure: status %d, replayed %q", status, header.Get("Idempotent-Replayed"))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	configure(t, "-trustproxy", "10.0.0.0/8, 192.168.1.5")
+	for _, tc := range []struct {
+		remote, xff, want string
+	}{
+		{"203.0.113.9:1234", "1.2.3.4", "203.0.113.9"},                    // spoofed by an untrusted client
+		{"10.0.0.1:1234", "", "10.0.0.1"},                                 // trusted proxy without xff
+		{"10.0.0.1:1234", "6.6.6.6, 198.51.100.7", "198.51.100.7"},        // right-most untrusted hop
+		{"10.0.0.1:1234", "198.51.100.7, 10.0.0.2", "198.51.100.7"},       // chained trusted proxies
+		{"192.168.1.5:1234", "198.51.100.7, 192.168.1.5", "198.51.100.7"}, // a single trusted host
+		{"192.168.1.6:1234", "198.51.100.7", "192.168.1.6"},               // outside the trusted list
+		{"10.0.0.1:1234", "198.51.100.7, garbage", "10.0.0.1"},            // garbage ends the chain
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("clientIP(%s, XFF %q) = %s, want %s", tc.remote, tc.xff, got, tc.want)
+		}
+	}
+
+	// without -trustproxy xff is never honored
+	configure(t)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if got := clientIP(r); got != "10.0.0.1" {
+		t.Errorf("clientIP without -trustproxy = %s", got)
+	}
+}
+
+func TestBufferedLog(t *testing.T) {
+	srv, _ := newTestServer(t, "-logformat", "json", "-logbuffer", "65536")
+	var out safeBuffer
+	logSink = &bufferedSink{w: bufio.NewWriterSize(&out, logBuffer)}
+	defer func() { logSink = nil }()
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		do(t, "GET", srv.URL+"/ts?i="+strconv.Itoa(i), nil)
+	}
+	if out.String() != "" {
+		t.Errorf("lines written before the flush:\n%s", out.String())
+	}
+
+	// the shutdown hook
+	logSink.Flush()
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != n {
+		t.Fatalf("%d lines flushed, want %d", len(lines), n)
+	}
+	for i, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line %d is not json: %v: %s", i, err, line)
+		}
+		if entry["uri"] != "/ts?i="+strconv.Itoa(i) || entry["status"] != float64(200) {
+			t.Errorf("line %d: %s", i, line)
+		}
+	}
+}
+
+// -logbuffer with text logs is rejected at startup instead of being ignored
+func TestBufferedTextLogRejected(t *testing.T) {
+	if os.Getenv("GOFS_PREPARE_ARGS") != "" {
+		log.SetOutput(os.Stderr)
+		fs := flag.NewFlagSet("gofs", flag.ExitOnError)
+		registerFlags(fs)
+		fs.Parse(append([]string{"-dir", t.TempDir()}, strings.Fields(os.Getenv("GOFS_PREPARE_ARGS"))...))
+		prepare()
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestBufferedTextLogRejected$")
+	cmd.Env = append(os.Environ(), "GOFS_PREPARE_ARGS=-logbuffer 4096")
+	out, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); !ok || !strings.Contains(string(out), "-logbuffer needs -logformat json or combined") {
+		t.Errorf("not rejected: %v\n%s", err, out)
+	}
+}
+
+func TestExtensionlessType(t *testing.T) {
+	srv, root := newTestServer(t)
+	writeFile(t, filepath.Join(root, "LICENSE"), "Permission is hereby granted, free of charge.\n")
+	writeFile(t, filepath.Join(root, "page"), "<!DOCTYPE html><html><body>hi</body></html>")
+	writeFile(t, filepath.Join(root, "blob"), "\x00\x01\x02\x03binary")
+
+	for name, want := range map[string]string{
+		"LICENSE": "text/plain; charset=utf-8",
+		"page":    "text/plain; charset=utf-8", // never sniffed into active content
+		"blob":    "application/octet-stream",
+	} {
+		_, _, header := do(t, "GET", srv.URL+"/"+name, nil)
+		if header.Get("Content-Type") != want {
+			t.Errorf("%s served as %q, want %q", name, header.Get("Content-Type"), want)
+		}
+		if header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s without nosniff", name)
+		}
+	}
+}
+
+func TestMotd(t *testing.T) {
+	srv, root := newTestServer(t, "-auth", "user:pass", "-motdfile", "motd.txt")
+	cred := []string{"Authorization", basicAuth("user:pass")}
+
+	if status, _, _ := postForm(t, srv.URL+"/motd", url.Values{"message": {"x"}}); status != http.StatusUnauthorized {
+		t.Errorf("anonymous set: status %d", status)
+	}
+	if status, body, _ := postForm(t, srv.URL+"/motd", url.Values{"message": {" Maintenance <tonight> "}}, cred...); status != http.StatusOK {
+		t.Fatalf("set: status %d: %s", status, body)
+	}
+	if _, body, _ := do(t, "GET", srv.URL+"/motd", nil, cred...); body != "Maintenance <tonight>" {
+		t.Errorf("get %q", body)
+	}
+	if _, body, _ := do(t, "GET", srv.URL+"/motd", nil, append(cred, "Accept", "application/json")...); body != `{"message":"Maintenance \u003ctonight\u003e"}`+"\n" {
+		t.Errorf("get json %s", body)
+	}
+	for _, p := range []string{"/", "/upload"} {
+		if _, body, _ := do(t, "GET", srv.URL+p, nil, cred...); !strings.Contains(body, "📢 Maintenance &lt;tonight&gt;") {
+			t.Errorf("%s does not render the motd:\n%s", p, body)
+		}
+	}
+
+	if status, _, _ := postForm(t, srv.URL+"/motd", url.Values{"message": {strings.Repeat("x", maxMotdSize+1)}}, cred...); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized: status %d", status)
+	}
+
+	// persisted, kept in place by the sweeper and restored on restart
+	organizeOnce()
+	if data, err := os.ReadFile(filepath.Join(root, "motd.txt")); err != nil || string(data) != "Maintenance <tonight>" {
+		t.Errorf("motd file %q %v", data, err)
+	}
+	srv, _ = newTestServer(t, "-dir", root, "-motdfile", "motd.txt")
+	if _, body, _ := do(t, "GET", srv.URL+"/motd", nil); body != "Maintenance <tonight>" {
+		t.Errorf("after a restart %q", body)
+	}
+	if status, _, _ := postForm(t, srv.URL+"/motd", url.Values{"message": {"x"}}); status != http.StatusForbidden {
+		t.Errorf("set without -auth: status %d", status)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	srv, root := newTestServer(t, "-quota", "10", "-quotawindow", "500ms")
+	put := func(name, content string) (int, http.Header) {
+		status, _, header := do(t, "PUT", srv.URL+"/upload/"+name, strings.NewReader(content))
+		return status, header
+	}
+
+	if status, _ := put("a", "123456"); status != http.StatusOK {
+		t.Fatalf("first upload: status %d", status)
+	}
+	if status, _ := put("b", "12345"); status != http.StatusTooManyRequests {
+		t.Errorf("upload over the quota: status %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(root, "b")); !os.IsNotExist(err) {
+		t.Errorf("rejected upload stored: %v", err)
+	}
+	if status, _ := put("c", "1234"); status != http.StatusOK {
+		t.Errorf("upload up to the quota: status %d", status)
+	}
+	status, header := put("d", "1")
+	if status != http.StatusTooManyRequests || header.Get("Retry-After") == "" {
+		t.Errorf("exhausted quota: status %d, Retry-After %q", status, header.Get("Retry-After"))
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if status, _ := put("e", "1234567890"); status != http.StatusOK {
+		t.Errorf("after the window: status %d", status)
+	}
+}
+
+func TestQuotaConcurrent(t *testing.T) {
+	srv, root := newTestServer(t, "-quota", "10")
+
+	// a streamed upload of unknown length holds the whole quota while in flight
+	pr, pw := io.Pipe()
+	done := make(chan int)
+	go func() {
+		req, _ := http.NewRequest("PUT", srv.URL+"/upload/slow", pr)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	pw.Write([]byte("12345678"))
+	for i := 0; ; i++ {
+		if _, err := os.Stat(filepath.Join(root, "slow.part")); err == nil {
+			break
+		}
+		if i > 100 {
+			t.Fatal("slow upload did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status, _, _ := do(t, "PUT", srv.URL+"/upload/fast", strings.NewReader("12345678")); status != http.StatusTooManyRequests {
+		t.Errorf("concurrent upload: status %d, want 429", status)
+	}
+	pw.Close()
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("slow upload: status %d", status)
+	}
+
+	// settled to the 8 bytes stored, failures give their reservation back
+	if status, _, _ := do(t, "PUT", srv.URL+"/upload/slow", strings.NewReader("1"), "If-None-Match", "*"); status != http.StatusPreconditionFailed {
+		t.Errorf("failed precondition: status %d", status)
+	}
+	if status, _, _ := do(t, "PUT", srv.URL+"/upload/rest", strings.NewReader("12")); status != http.StatusOK {
+		t.Errorf("rest of the quota: status %d", status)
+	}
+	if status, _, _ := do(t, "PUT", srv.URL+"/upload/more", strings.NewReader("1")); status != http.StatusTooManyRequests {
+		t.Errorf("quota used up: status %d", status)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	srv, root := newTestServer(t)
+	name := filepath.Join(root, "data.bin")
+	writeFile(t, name, "payload")
+	sum := sha256Hex("payload")
+
+	verify := func(query string) (int, map[string]interface{}) {
+		status, body, _ := do(t, "GET", srv.URL+"/verify/data.bin"+query, nil)
+		var result map[string]interface{}
+		json.Unmarshal([]byte(body), &result)
+		return status, result
+	}
+
+	if status, result := verify("?sha256=" + strings.ToUpper(sum)); status != http.StatusOK || result["match"] != true || result["sha256"] != sum {
+		t.Errorf("matching: status %d, %v", status, result)
+	}
+	if status, result := verify("?sha256=" + sha256Hex("other")); status != http.StatusOK || result["match"] != false || result["sha256"] != sum {
+		t.Errorf("not matching: status %d, %v", status, result)
+	}
+	if status, result := verify(""); status != http.StatusOK || result["sha256"] != sum || result["match"] != nil {
+		t.Errorf("without sha256: status %d, %v", status, result)
+	}
+	if status, _ := verify("?sha256=xyz"); status != http.StatusBadRequest {
+		t.Errorf("malformed sha256: status %d", status)
+	}
+	if status, _, _ := do(t, "GET", srv.URL+"/verify/missing.bin", nil); status != http.StatusNotFound {
+		t.Errorf("missing file: status %d", status)
+	}
+
+	// the cached sum is dropped once the file changes
+	later := time.Now().Add(time.Hour)
+	writeFile(t, name, "changed")
+	os.Chtimes(name, later, later)
+	if _, result := verify(""); result["sha256"] != sha256Hex("changed") {
+		t.Errorf("stale checksum after a change: %v", result)
+	}
+}
+
+func TestConditionalUpload(t *testing.T) {
+	srv, _ := newTestServer(t)
+	put := func(name, content string, header ...string) (int, http.Header) {
+		status, _, h := do(t, "PUT", srv.URL+"/upload/"+name, strings.NewReader(content), header...)
+		return status, h
+	}
+
+	status, header := put("a.txt", "v1", "If-None-Match", "*")
+	if status != http.StatusOK || header.Get("ETag") == "" {
+		t.Fatalf("create if absent: status %d, ETag %q", status, header.Get("ETag"))
+	}
+	etag := header.Get("ETag")
+	if status, _ := put("a.txt", "v1 again", "If-None-Match", "*"); status != http.StatusPreconditionFailed {
+		t.Errorf("create over an existing file: status %d", status)
+	}
+
+	status, header = put("a.txt", "v2 longer", "If-Match", etag)
+	if status != http.StatusOK || header.Get("ETag") == etag {
+		t.Errorf("update if matching: status %d, ETag %q", status, header.Get("ETag"))
+	}
+	if status, _ := put("a.txt", "v3", "If-Match", etag); status != http.StatusPreconditionFailed {
+		t.Errorf("update with a stale etag: status %d", status)
+	}
+	if status, _ := put("new.txt", "v1", "If-Match", etag); status != http.StatusPreconditionFailed {
+		t.Errorf("update of a missing file: status %d", status)
+	}
+	if _, body, _ := do(t, "GET", srv.URL+"/a.txt", nil); body != "v2 longer" {
+		t.Errorf("content %q", body)
+	}
+}
+
+func TestTruncatedGzipUpload(t *testing.T) {
+	srv, root := newTestServer(t)
+	full := gzipString(t, strings.Repeat("complete line\n", 500))
+
+	if status, body, _ := do(t, "PUT", srv.URL+"/upload/ok.txt", strings.NewReader(full), "Content-Encoding", "gzip"); status != http.StatusOK {
+		t.Fatalf("complete gzip: status %d: %s", status, body)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "ok.txt")); string(data) != strings.Repeat("complete line\n", 500) {
+		t.Errorf("complete gzip stored %d bytes", len(data))
+	}
+
+	for _, cut := range []int{len(full) - 4, len(full) / 2} {
+		status, body, _ := do(t, "PUT", srv.URL+"/upload/cut.txt", strings.NewReader(full[:cut]), "Content-Encoding", "gzip")
+		if status != http.StatusBadRequest || !strings.Contains(body, "incomplete upload") {
+			t.Errorf("truncated at %d: status %d: %s", cut, status, body)
+		}
+	}
+	if status, _, _ := do(t, "PUT", srv.URL+"/upload/cut.txt", strings.NewReader("garbage"), "Content-Encoding", "gzip"); status != http.StatusBadRequest {
+		t.Errorf("not gzip: status %d", status)
+	}
+
+	files, _ := os.ReadDir(root)
+	if len(files) != 1 {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("partial uploads left behind: %v", names)
+	}
+}
+
+func TestListenerHandoff(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("graceful restart is not supported on windows")
+	}
+	if addrs := os.Getenv("GOFS_HANDOFF_CHILD"); addrs != "" {
+		// the restarted process, answer one request on each inherited listener
+		var wg sync.WaitGroup
+		for _, addr := range strings.Split(addrs, ",") {
+			ln, err := listen(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var once sync.Once
+			served := make(chan struct{})
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "pid %d on %s", os.Getpid(), ln.Addr())
+				once.Do(func() { close(served) })
+			})}
+			go srv.Serve(ln)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				select {
+				case <-served:
+				case <-time.After(10 * time.Second):
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				srv.Shutdown(ctx)
+			}()
+		}
+		wg.Wait()
+		return
+	}
+
+	// the https and the plain -httpport listener
+	listeners := map[string]net.Listener{}
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[ln.Addr().String()] = ln
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	// restart runs os.Args again, only this test and quietly
+	t.Setenv("GOFS_HANDOFF_CHILD", strings.Join(addrs, ","))
+	args, stdout := os.Args, os.Stdout
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	os.Args, os.Stdout = []string{args[0], "-test.run=^TestListenerHandoff$"}, devnull
+	err = restart(listeners)
+	os.Args, os.Stdout = args, stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the old process stops accepting, the sockets stay open in the new one
+	for _, ln := range listeners {
+		ln.Close()
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, addr := range addrs {
+		resp, err := client.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatalf("no one accepting on %s after the handoff: %v", addr, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if self := fmt.Sprintf("pid %d ", os.Getpid()); strings.HasPrefix(string(body), self) || !strings.HasSuffix(string(body), " on "+addr) {
+			t.Errorf("%s answered by %s, want a new process", addr, body)
+		}
+	}
+
+	if err := restart(map[string]net.Listener{"/tmp/gofs.sock": &net.UnixListener{}}); err == nil {
+		t.Error("restart passed a non-tcp listener")
+	}
+}
+
+func TestHTTPRedirect(t *testing.T) {
+	configure(t, "-port", "8443")
+	plain := httptest.NewServer(plainHandler(newHandler(), nil))
+	defer plain.Close()
+
+	for _, tc := range []struct {
+		method, host, path string
+		location           string
+	}{
+		{"GET", "files.example.com:8080", "/bar/a.txt?x=1", "https://files.example.com:8443/bar/a.txt?x=1"},
+		{"POST", "files.example.com", "/upload", "https://files.example.com:8443/upload"},
+		{"GET", "[::1]:8080", "/", "https://[::1]:8443/"},
+	} {
+		req, _ := http.NewRequest(tc.method, plain.URL+tc.path, nil)
+		req.Host = tc.host
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != tc.location {
+			t.Errorf("%s %s%s: status %d, location %q, want %q", tc.method, tc.host, tc.path, resp.StatusCode, resp.Header.Get("Location"), tc.location)
+		}
+	}
+
+	// the default https port is left out
+	configure(t, "-port", "443")
+	plain = httptest.NewServer(plainHandler(newHandler(), nil))
+	defer plain.Close()
+	if _, _, header := do(t, "GET", plain.URL+"/ip", nil); header.Get("Location") != "https://127.0.0.1/ip" {
+		t.Errorf("location %q", header.Get("Location"))
+	}
+
+	// -httpredirect=false serves plain http too
+	configure(t, "-httpredirect=false")
+	plain = httptest.NewServer(plainHandler(newHandler(), nil))
+	defer plain.Close()
+	if status, _, _ := do(t, "GET", plain.URL+"/ip", nil); status != http.StatusOK {
+		t.Errorf("without redirect: status %d", status)
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	srv, _ := newTestServer(t, "-slowlog", "150ms", "-logsample", "100")
+	logs := captureLog(t)
+
+	for i := 0; i < 3; i++ {
+		if status, _, _ := do(t, "GET", srv.URL+"/ip", nil); status != http.StatusOK {
+			t.Fatalf("fast request: status %d", status)
+		}
+	}
+	if status, _, _ := do(t, "GET", srv.URL+"/delay/300ms", nil); status != http.StatusOK {
+		t.Fatalf("slow request: status %d", status)
+	}
+
+	out := logs.String()
+	if strings.Contains(out, "/ip") {
+		t.Errorf("fast requests logged:\n%s", out)
+	}
+	// sampling does not apply, every slow request is logged with its status and duration
+	line := regexp.MustCompile(`\[INFO\] \S+ GET /delay/300ms 200 \d+B (\S+)`).FindStringSubmatch(out)
+	if line == nil {
+		t.Fatalf("slow request not logged:\n%s", out)
+	}
+	if d, err := time.ParseDuration(line[1]); err != nil || d < 300*time.Millisecond {
+		t.Errorf("logged duration %q, want at least 300ms", line[1])
+	}
+}
+
+func TestActiveUploads(t *testing.T) {
+	srv, root := newTestServer(t, "-auth", "user:pass")
+	auth := basicAuth("user:pass")
+
+	// a multipart upload still being sent, half of the file part so far
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		mw.WriteField("path", "slow")
+		fw, _ := mw.CreateFormFile("file", "big.bin")
+		fw.Write(bytes.Repeat([]byte("x"), 64<<10))
+	}()
+	type result struct {
+		status int
+		body   string
+	}
+	done := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequest("POST", srv.URL+"/upload", pr)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			done <- result{0, err.Error()}
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		done <- result{resp.StatusCode, string(body)}
+	}()
+	defer pw.Close()
+
+	// listed while the body is streamed, before it is complete
+	var active []struct {
+		ID       string
+		Path     string
+		Received int64
+		ClientIP string `json:"client_ip"`
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, body, _ := do(t, "GET", srv.URL+"/uploads/active", nil, "Authorization", auth)
+		if err := json.Unmarshal([]byte(body), &active); err != nil {
+			t.Fatalf("%v: %s", err, body)
+		}
+		if len(active) == 1 && active[0].Received > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upload not listed as active: %s", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if active[0].Path != "/slow/big.bin" || active[0].ClientIP != "127.0.0.1" {
+		t.Errorf("active upload %+v", active[0])
+	}
+
+	if status, _, _ := do(t, "POST", srv.URL+"/uploads/"+active[0].ID+"/cancel", nil); status != http.StatusUnauthorized {
+		t.Errorf("cancel without credentials: status %d", status)
+	}
+	if status, body, _ := do(t, "POST", srv.URL+"/uploads/"+active[0].ID+"/cancel", nil, "Authorization", auth); status != http.StatusOK {
+		t.Fatalf("cancel: status %d: %s", status, body)
+	}
+	// the upload fails even though the client keeps sending
+	go func() {
+		pw.Write(bytes.Repeat([]byte("x"), 64<<10))
+		pw.Close()
+	}()
+	select {
+	case res := <-done:
+		if res.status != http.StatusConflict || !strings.Contains(res.body, "upload canceled") {
+			t.Errorf("canceled upload: status %d: %s", res.status, res.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled upload did not finish")
+	}
+
+	if _, body, _ := do(t, "GET", srv.URL+"/uploads/active", nil, "Authorization", auth); strings.TrimSpace(body) != "[]" {
+		t.Errorf("still active after cancel: %s", body)
+	}
+	if _, err := os.Stat(filepath.Join(root, "slow", "big.bin")); err == nil {
+		t.Error("canceled upload stored")
+	}
+	if files, _ := os.ReadDir(filepath.Join(root, "slow")); len(files) != 0 {
+		t.Errorf("partial upload left: %s", files[0].Name())
+	}
+	if status, _, _ := do(t, "POST", srv.URL+"/uploads/"+active[0].ID+"/cancel", nil, "Authorization", auth); status != http.StatusNotFound {
+		t.Errorf("cancel of a finished upload: status %d", status)
+	}
+}
+
+func TestUploadFieldOrder(t *testing.T) {
+	srv, root := newTestServer(t)
+
+	// the path field before the file part places the file
+	if status, body, _ := uploadForm(t, srv.URL+"/upload", map[string]string{"path": "before"}, "a.txt", "a"); status != http.StatusOK {
+		t.Fatalf("path first: status %d: %s", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(root, "before", "a.txt")); err != nil {
+		t.Errorf("path first: %v", err)
+	}
+
+	// after it, it is refused instead of being ignored
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "b.txt")
+	io.WriteString(fw, "b")
+	mw.WriteField("path", "after")
+	mw.Close()
+	if status, body, _ := do(t, "POST", srv.URL+"/upload", &body, "Content-Type", mw.FormDataContentType()); status != http.StatusBadRequest {
+		t.Errorf("path last: status %d: %s", status, body)
+	}
+	for _, name := range []string{"b.txt", "b.txt.part", "after/b.txt"} {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("path last left %s: %v", name, err)
+		}
+	}
+}
+
+func TestSecureHeaders(t *testing.T) {
+	srv, _ := newTestServer(t, "-secure")
+
+	_, _, header := do(t, "GET", srv.URL+"/ip", nil)
+	for name, want := range map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "SAMEORIGIN",
+		"Referrer-Policy":         "same-origin",
+		"Content-Security-Policy": cspPolicy,
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%s: %q, want %q", name, got, want)
+		}
+	}
+
+	// the upload page renders, its form may post into the iframe at the advertised address
+	status, body, header := do(t, "GET", srv.URL+"/upload", nil)
+	if status != http.StatusOK || !strings.Contains(body, `<form enctype="multipart/form-data"`) || !strings.Contains(body, `<iframe id="iiframe"`) {
+		t.Fatalf("upload page: status %d: %s", status, body)
+	}
+	csp := header.Get("Content-Security-Policy")
+	if !strings.HasPrefix(csp, cspPolicy+"; ") || !strings.Contains(csp, "form-action 'self' http://") || !strings.Contains(csp, "frame-src 'self' http://") {
+		t.Errorf("upload page csp: %q", csp)
+	}
+	if header.Get("X-Frame-Options") != "" || header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("upload page headers: %v", header)
+	}
+
+	srv, _ = newTestServer(t, "-secure", "-csp", "default-src 'none'")
+	if _, _, header := do(t, "GET", srv.URL+"/ip", nil); header.Get("Content-Security-Policy") != "default-src 'none'" {
+		t.Errorf("custom csp: %q", header.Get("Content-Security-Policy"))
+	}
+
+	srv, _ = newTestServer(t)
+	_, _, header = do(t, "GET", srv.URL+"/upload", nil)
+	for _, name := range []string{"X-Content-Type-Options", "X-Frame-Options", "Referrer-Policy", "Content-Security-Policy"} {
+		if header.Get(name) != "" {
+			t.Errorf("%s sent without -secure", name)
+		}
+	}
+}
+
+func TestHLS(t *testing.T) {
+	srv, root := newTestServer(t)
+	if status, _, _ := do(t, "GET", srv.URL+"/hls/movie.mp4.m3u8", nil); status != http.StatusNotFound {
+		t.Errorf("without -hls: status %d", status)
+	}
+	srv, _ = newTestServer(t, "-hls", "-ffmpeg", filepath.Join(root, "no-ffmpeg"))
+	if status, body, _ := do(t, "GET", srv.URL+"/hls/movie.mp4.m3u8", nil); status != http.StatusNotImplemented {
+		t.Errorf("without ffmpeg: status %d: %s", status, body)
+	}
+
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg not found")
+	}
+	srv, root = newTestServer(t, "-hls", "-hlsdir", t.TempDir())
+	video := filepath.Join(root, "media", "movie.mp4")
+	os.MkdirAll(filepath.Dir(video), 0755)
+	if out, err := exec.Command(ffmpeg, "-v", "error", "-f", "lavfi", "-i", "testsrc=duration=14:size=64x48:rate=10",
+		"-c:v", "libx264", "-g", "10", video).CombinedOutput(); err != nil {
+		if out, err = exec.Command(ffmpeg, "-v", "error", "-f", "lavfi", "-i", "testsrc=duration=14:size=64x48:rate=10",
+			"-c:v", "mpeg4", "-g", "10", video).CombinedOutput(); err != nil {
+			t.Skipf("cannot encode a test video: %v %s", err, out)
+		}
+	}
+	writeFile(t, filepath.Join(root, "notes.txt"), "not a video")
+
+	status, playlist, header := do(t, "GET", srv.URL+"/hls/media/movie.mp4.m3u8", nil)
+	if status != http.StatusOK || header.Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Fatalf("playlist: status %d: %s", status, playlist)
+	}
+	var segments []string
+	for _, line := range strings.Split(playlist, "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			segments = append(segments, line)
+		}
+	}
+	if len(segments) < 2 || segments[0] != "movie.mp4.m3u8/seg00000.ts" {
+		t.Fatalf("segments %v in\n%s", segments, playlist)
+	}
+	status, segment, header := do(t, "GET", srv.URL+"/hls/media/"+segments[1], nil)
+	if status != http.StatusOK || header.Get("Content-Type") != "video/mp2t" || len(segment) == 0 || segment[0] != 0x47 {
+		t.Errorf("segment %s: status %d, %d bytes", segments[1], status, len(segment))
+	}
+
+	if status, _, _ := do(t, "GET", srv.URL+"/hls/media/movie.mp4.m3u8/../../notes.txt", nil); status == http.StatusOK {
+		t.Error("segment path escapes the cache")
+	}
+	if status, _, _ := do(t, "GET", srv.URL+"/hls/notes.txt.m3u8", nil); status != http.StatusUnsupportedMediaType {
+		t.Errorf("not a video: status %d", status)
+	}
+	if status, _, _ := do(t, "GET", srv.URL+"/hls/missing.mp4.m3u8", nil); status != http.StatusNotFound {
+		t.Errorf("missing video: status %d", status)
+	}
+}
+
+func TestMetricRollup(t *testing.T) {
+	srv, root := newTestServer(t)
+	names := []string{"a.txt", "b.txt", "sub/c.txt", "sub/deep/d.txt", "randint.txt"}
+	for _, name := range names {
+		writeFile(t, filepath.Join(root, filepath.FromSlash(name)), name)
+	}
+	for _, name := range names {
+		if status, _, _ := do(t, "GET", srv.URL+"/"+name, nil); status != http.StatusOK {
+			t.Fatalf("GET %s: status %d", name, status)
+		}
+	}
+	do(t, "GET", srv.URL+"/sub/", nil)
+	do(t, "GET", srv.URL+"/randint/50", nil)
+	do(t, "GET", srv.URL+"/randint/7", nil)
+
+	series := map[string]string{}
+	for _, line := range strings.Split(scrape(t, srv.URL), "\n") {
+		if m := regexp.MustCompile(`^gofs_request_total\{app="gofs", path="([^"]*)"\} (\d+)$`).FindStringSubmatch(line); m != nil {
+			series[m[1]] = m[2]
+		}
+	}
+	// the file downloads and the listing are one series, the utility routes one per route
+	if series["/"] != strconv.Itoa(len(names)+1) || series["/randint"] != "2" || len(series) != 2 {
+		t.Errorf("request series %v", series)
+	}
+}
+
+func TestMinTLS(t *testing.T) {
+	handshake := func(addr string, version uint16, suites ...uint16) error {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MinVersion: version, MaxVersion: version, CipherSuites: suites})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	start := func(args ...string) string {
+		configure(t, args...)
+		srv := httptest.NewUnstartedServer(newHandler())
+		srv.TLS = secureTLS(&tls.Config{})
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv.Listener.Addr().String()
+	}
+
+	addr := start()
+	if err := handshake(addr, tls.VersionTLS11); err == nil {
+		t.Error("tls 1.1 accepted")
+	}
+	if err := handshake(addr, tls.VersionTLS13); err != nil {
+		t.Errorf("tls 1.3: %v", err)
+	}
+	if err := handshake(addr, tls.VersionTLS12); err != nil {
+		t.Errorf("tls 1.2: %v", err)
+	}
+	// only the curated forward secret suites are offered for tls 1.2
+	if err := handshake(addr, tls.VersionTLS12, tls.TLS_RSA_WITH_AES_128_GCM_SHA256); err == nil {
+		t.Error("tls 1.2 without forward secrecy accepted")
+	}
+
+	addr = start("-mintls", "1.3")
+	if err := handshake(addr, tls.VersionTLS12); err == nil {
+		t.Error("tls 1.2 accepted with -mintls 1.3")
+	}
+	if err := handshake(addr, tls.VersionTLS13); err != nil {
+		t.Errorf("tls 1.3 with -mintls 1.3: %v", err)
+	}
+}
+
+func TestURL(t *testing.T) {
+	srv, _ := newTestServer(t, "-trustproxy", "127.0.0.1")
+	t.Setenv("WEBHOST", "")
+	t.Setenv("WEBPORT", "")
+	t.Setenv("WEBPROTOCOL", "")
+	local := fmt.Sprintf("%s://%s:%s", protocol, host, port)
+
+	forwarded := []string{"X-Forwarded-Proto", "https", "X-Forwarded-Host", "files.example.com", "X-Forwarded-Prefix", "/gofs/"}
+	for _, tc := range []struct {
+		path   string
+		header []string
+		want   string
+	}{
+		{"/url/bar/sample.pdf", nil, local + "/bar/sample.pdf"},
+		{"/url/bar/my%20file.pdf", nil, local + "/bar/my%20file.pdf"},
+		{"/url/", nil, local + "/"},
+		{"/url/bar/sample.pdf", forwarded, "https://files.example.com:443/gofs/bar/sample.pdf"},
+		{"/url/bar/sample.pdf", []string{"X-Forwarded-Host", "files.example.com:8443", "X-Forwarded-Prefix", "gofs"}, "http://files.example.com:8443/gofs/bar/sample.pdf"},
+		{"/url/bar/sample.pdf", []string{"X-Forwarded-Host", "files.example.com", "X-Forwarded-Port", "8080"}, local[:strings.Index(local, "://")] + "://files.example.com:8080/bar/sample.pdf"},
+		// invalid ports are ignored, with the host they came with
+		{"/url/a", []string{"X-Forwarded-Host", `evil.example.com:"><script>`}, local + "/a"},
+		{"/url/a", []string{"X-Forwarded-Host", "files.example.com", "X-Forwarded-Port", "80x"}, local[:strings.Index(local, "://")] + "://files.example.com:" + port + "/a"},
+	} {
+		status, body, _ := do(t, "GET", srv.URL+tc.path, nil, tc.header...)
+		if status != http.StatusOK || body != tc.want {
+			t.Errorf("GET %s %v: status %d: %q, want %q", tc.path, tc.header, status, body, tc.want)
+		}
+	}
+
+	var link struct{ Path, URL string }
+	_, body, _ := do(t, "GET", srv.URL+"/url/bar/sample.pdf", nil, append([]string{"Accept", "application/json"}, forwarded...)...)
+	if err := json.Unmarshal([]byte(body), &link); err != nil || link.Path != "/bar/sample.pdf" || link.URL != "https://files.example.com:443/gofs/bar/sample.pdf" {
+		t.Errorf("json: %s", body)
+	}
+
+	// the upload page builds its links the same way
+	_, page, _ := do(t, "GET", srv.URL+"/upload", nil, forwarded...)
+	if !strings.Contains(page, `action="https://files.example.com:443/gofs/upload"`) {
+		t.Errorf("upload page does not use the forwarded address:\n%s", page)
+	}
+
+	// headers from untrusted peers are ignored
+	srv, _ = newTestServer(t)
+	if _, body, _ := do(t, "GET", srv.URL+"/url/a", nil, forwarded...); body != local+"/a" {
+		t.Errorf("untrusted forwarded headers: %q", body)
+	}
+}
+
+func TestUploadPageEscaping(t *testing.T) {
+	srv, _ := newTestServer(t)
+	t.Setenv("WEBHOST", "")
+	t.Setenv("WEBPROTOCOL", "http")
+	t.Setenv("WEBPORT", `80"><script>alert(1)</script>`)
+	_, page, _ := do(t, "GET", srv.URL+"/upload", nil)
+	if strings.Contains(page, "<script>") || !strings.Contains(page, "&lt;script&gt;") {
+		t.Errorf("port not escaped:\n%s", page)
+	}
+}
+
+// the mirror worker started by main, shared by the tests
+var mirrorWorker sync.Once
+
+func waitMirror(t *testing.T) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		mirrorPending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("mirror still pending")
+	}
+}
+
+func TestMirror(t *testing.T) {
+	type received struct {
+		path, encoding, body string
+	}
+	var mu sync.Mutex
+	var got []received
+	release := make(chan struct{})
+	attempts := 0
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if attempts++; attempts == 1 {
+			http.Error(w, "✘ Failed: try again", http.StatusServiceUnavailable)
+			return
+		}
+		got = append(got, received{r.Method + " " + r.URL.Path, r.Header.Get("Content-Encoding"), string(body)})
+	}))
+	defer secondary.Close()
+	mirrorWorker.Do(func() { go mirrorUploads() })
+
+	srv, _ := newTestServer(t, "-mirror", secondary.URL)
+	payload := strings.Repeat("mirrored payload\n", 100)
+	// the client does not wait for the replication
+	if status, body, _ := uploadForm(t, srv.URL+"/upload/drop/", nil, "a b.txt", payload); status != http.StatusOK {
+		t.Fatalf("upload: status %d: %s", status, body)
+	}
+	close(release)
+	waitMirror(t)
+
+	// retried after the first failure
+	if attempts != 2 || len(got) != 1 || got[0] != (received{"PUT /upload/drop/a b.txt", "", payload}) {
+		t.Errorf("%d attempts, secondary received %+v", attempts, got)
+	}
+
+	// a second directory, compressed uploads are copied as they are stored
+	second := t.TempDir()
+	srv, _ = newTestServer(t, "-mirror", second, "-compressstore")
+	if status, body, _ := uploadForm(t, srv.URL+"/upload/drop/", nil, "b.txt", payload); status != http.StatusOK {
+		t.Fatalf("upload: status %d: %s", status, body)
+	}
+	waitMirror(t)
+	data, err := os.ReadFile(filepath.Join(second, "drop", "b.txt.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := gunzipString(t, string(data)); text != payload {
+		t.Errorf("mirrored %d bytes, want %d", len(text), len(payload))
+	}
+	if files, _ := os.ReadDir(filepath.Join(second, "drop")); len(files) != 1 {
+		t.Errorf("%d files in the mirror, want b.txt.gz only", len(files))
+	}
+}
+
+// response recorder remembering how many lines were written at each flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushed = append(f.flushed, strings.Count(f.Body.String(), "\n"))
+	f.ResponseRecorder.Flush()
+}
+
+func TestNDJSONListing(t *testing.T) {
+	srv, root := newTestServer(t)
+	const n = 600
+	for i := 0; i < n; i++ {
+		writeFile(t, filepath.Join(root, "big", fmt.Sprintf("f%03d.txt", i)), "x")
+	}
+	os.Mkdir(filepath.Join(root, "big", "sub"), 0755)
+
+	status, body, header := do(t, "GET", srv.URL+"/big/?format=ndjson", nil, "Accept-Encoding", "identity")
+	if status != http.StatusOK || header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("status %d, content type %q", status, header.Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	if len(lines) != n+1 {
+		t.Fatalf("%d lines, want %d", len(lines), n+1)
+	}
+	names := map[string]bool{}
+	for _, line := range lines {
+		var e Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		names[e.Name] = e.IsDir
+	}
+	if len(names) != n+1 || !names["sub"] || names["f000.txt"] {
+		t.Errorf("entries %v", names)
+	}
+
+	// filters apply to the stream too
+	_, body, _ = do(t, "GET", srv.URL+"/big/?format=ndjson&type=dir", nil)
+	if strings.Count(body, "\n") != 1 || !strings.Contains(body, `"name":"sub"`) {
+		t.Errorf("type=dir: %s", body)
+	}
+
+	// flushed batch by batch instead of buffered whole
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	streamEntries(rec, httptest.NewRequest("GET", "/big/?format=ndjson", nil), filepath.Join(root, "big"))
+	if len(rec.flushed) < 3 || rec.flushed[0] == 0 || rec.flushed[0] >= n {
+		t.Errorf("lines written at each flush %v", rec.flushed)
+	}
+}
+
+func TestUploadPage(t *testing.T) {
+	srv, _ := newTestServer(t)
+	status, page, _ := do(t, "GET", srv.URL+"/upload", nil)
+	if status != http.StatusOK || !strings.Contains(page, "<form") || !strings.Contains(page, "-F \"file=@") || strings.Contains(page, "read-only") {
+		t.Errorf("upload page: status %d:\n%s", status, page)
+	}
+
+	// read-only, no form and no upload or delete commands
+	srv, _ = newTestServer(t, "-readonly")
+	status, page, _ = do(t, "GET", srv.URL+"/upload", nil)
+	if status != http.StatusOK || strings.Contains(page, "<form") || strings.Contains(page, "/delete") || strings.Contains(page, "-F \"file=@") ||
+		!strings.Contains(page, "Uploads are disabled, this server is read-only.") || !strings.Contains(page, "/bar/sample.pdf") {
+		t.Errorf("read-only upload page: status %d:\n%s", status, page)
+	}
+	if status, _, _ := uploadForm(t, srv.URL+"/upload", nil, "a.txt", "a"); status != http.StatusForbidden {
+		t.Errorf("read-only upload: status %d", status)
+	}
+
+	// the page needs the same credentials as the upload, even when browsing is open
+	srv, _ = newTestServer(t, "-auth", "user:pass", "-authrule", "/=optional", "-authrule", "/upload=required")
+	status, page, header := do(t, "GET", srv.URL+"/upload", nil)
+	if status != http.StatusUnauthorized || strings.Contains(page, "<form") || header.Get("WWW-Authenticate") == "" {
+		t.Errorf("unauthenticated upload page: status %d:\n%s", status, page)
+	}
+	if status, page, _ := do(t, "GET", srv.URL+"/upload", nil, "Authorization", basicAuth("user:wrong")); status != http.StatusUnauthorized || strings.Contains(page, "<form") {
+		t.Errorf("wrong credentials: status %d", status)
+	}
+	if status, page, _ := do(t, "GET", srv.URL+"/upload", nil, "Authorization", basicAuth("user:pass")); status != http.StatusOK || !strings.Contains(page, "<form") {
+		t.Errorf("authenticated upload page: status %d", status)
+	}
+	if status, _, _ := do(t, "GET", srv.URL+"/ip", nil); status != http.StatusOK {
+		t.Errorf("open route: status %d", status)
+	}
+}
+
+func TestAggregateETag(t *testing.T) {
+	srv, root := newTestServer(t)
+	writeFile(t, filepath.Join(root, "bar", "a.txt"), "aaa")
+	writeFile(t, filepath.Join(root, "bar", "sub", "b.txt"), "bbb")
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"bar/a.txt", "bar/sub/b.txt", "bar/sub", "bar"} {
+		os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), old, old)
+	}
+
+	for _, route := range []string{"/manifest/bar", "/manifest/bar?format=json", "/tree/bar"} {
+		status, _, header := do(t, "GET", srv.URL+route, nil)
+		etag := header.Get("ETag")
+		if status != http.StatusOK || !regexp.MustCompile(`^"[0-9a-f]+"$`).MatchString(etag) {
+			t.Fatalf("GET %s: status %d, etag %q", route, status, etag)
+		}
+		if _, _, header := do(t, "GET", srv.URL+route, nil); header.Get("ETag") != etag {
+			t.Errorf("GET %s: etag changed from %s to %s", route, etag, header.Get("ETag"))
+		}
+		if status, body, _ := do(t, "GET", srv.URL+route, nil, "If-None-Match", etag); status != http.StatusNotModified || body != "" {
+			t.Errorf("GET %s If-None-Match: status %d", route, status)
+		}
+		if status, _, _ := do(t, "GET", srv.URL+route, nil, "If-None-Match", `"other", W/`+etag); status != http.StatusNotModified {
+			t.Errorf("GET %s weak If-None-Match list: status %d", route, status)
+		}
+	}
+
+	_, _, text := do(t, "GET", srv.URL+"/manifest/bar", nil)
+	_, _, jsonHeader := do(t, "GET", srv.URL+"/manifest/bar?format=json", nil)
+	if text.Get("ETag") == jsonHeader.Get("ETag") {
+		t.Error("text and json manifests share an etag")
+	}
+
+	// any change below the directory invalidates it
+	for _, change := range []func(){
+		func() { os.WriteFile(filepath.Join(root, "bar", "sub", "b.txt"), []byte("bbbb"), 0644) },
+		func() { os.Chtimes(filepath.Join(root, "bar", "a.txt"), time.Now(), time.Now()) },
+		func() { writeFile(t, filepath.Join(root, "bar", "sub", "c.txt"), "") },
+	} {
+		_, _, before := do(t, "GET", srv.URL+"/manifest/bar", nil)
+		_, _, treeBefore := do(t, "GET", srv.URL+"/tree/bar", nil)
+		change()
+		if status, _, header := do(t, "GET", srv.URL+"/manifest/bar", nil, "If-None-Match", before.Get("ETag")); status != http.StatusOK || header.Get("ETag") == before.Get("ETag") {
+			t.Errorf("manifest after a change: status %d, etag %s", status, header.Get("ETag"))
+		}
+		if status, _, header := do(t, "GET", srv.URL+"/tree/bar", nil, "If-None-Match", treeBefore.Get("ETag")); status != http.StatusOK || header.Get("ETag") == treeBefore.Get("ETag") {
+			t.Errorf("tree after a change: status %d, etag %s", status, header.Get("ETag"))
+		}
+	}
+}
+
+// run the self-test against the configured handler, with its report
+func selfTestReport(t *testing.T) (int, string) {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "selftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	failed := runSelfTest(newHandler())
+	os.Stdout = stdout
+	report, _ := os.ReadFile(out.Name())
+	return failed, string(report)
+}
+
+func TestSelfTest(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"-auth", "user:pass", "-uploaddir", "incoming"},
+		{"-auth", "user:pass", "-metricsauth", "m:n"},
+	} {
+		root := configure(t, args...)
+		failed, report := selfTestReport(t)
+		if failed != 0 || !strings.Contains(report, "selftest passed: 6 checks") {
+			t.Errorf("%v: %d failed:\n%s", args, failed, report)
+		}
+		for _, check := range []string{"upload", "download", "delete", "echo", "ts", "metrics"} {
+			if !strings.Contains(report, "✔ "+check+"\n") {
+				t.Errorf("%v: no %s check in\n%s", args, check, report)
+			}
+		}
+		// the uploaded probe is deleted again
+		filepath.Walk(root, func(fullpath string, fi os.FileInfo, err error) error {
+			if err == nil && strings.HasPrefix(fi.Name(), ".gofs-selftest-") {
+				t.Errorf("%v: left %s behind", args, fullpath)
+			}
+			return nil
+		})
+	}
+
+	// healthy deployments whose configuration rules some checks out pass too
+	file := filepath.Join(t.TempDir(), "report.pdf")
+	writeFile(t, file, "%PDF-1.4 single")
+	for _, tc := range []struct {
+		args    []string
+		passed  int
+		skipped []string
+	}{
+		{[]string{"-readonly"}, 3, []string{"upload", "download", "delete"}},
+		{[]string{"-snapshot", "-snapshotdir", t.TempDir()}, 6, nil},
+		{[]string{"-snapshot", "-snapshotdir", t.TempDir(), "-compressstore"}, 6, nil},
+		{[]string{"-file", file}, 4, []string{"upload", "delete"}},
+		{[]string{"-file", file, "-readonly"}, 4, []string{"upload", "delete"}},
+		{[]string{"-allowext", "zip,pdf"}, 6, nil},
+		{[]string{"-denyext", "txt"}, 6, nil},
+	} {
+		root := configure(t, tc.args...)
+		failed, report := selfTestReport(t)
+		if failed != 0 || !strings.Contains(report, fmt.Sprintf("selftest passed: %d checks", tc.passed)) {
+			t.Errorf("%v: %d failed:\n%s", tc.args, failed, report)
+		}
+		for _, check := range tc.skipped {
+			if !strings.Contains(report, "- "+check+": skipped") {
+				t.Errorf("%v: %s not skipped in\n%s", tc.args, check, report)
+			}
+		}
+		filepath.Walk(root, func(fullpath string, fi os.FileInfo, err error) error {
+			if err == nil && strings.HasPrefix(fi.Name(), ".gofs-selftest-") {
+				t.Errorf("%v: left %s behind", tc.args, fullpath)
+			}
+			return nil
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	srv, root := newTestServer(t, "-foldcase")
+	writeFile(t, filepath.Join(root, "Bar", "File.TXT"), "case kept")
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		location     string
+	}{
+		{"GET", "//echo/201", http.StatusMovedPermanently, "/echo/201"},
+		{"GET", "/echo/../ip", http.StatusMovedPermanently, "/ip"},
+		{"GET", "/Echo/201", http.StatusMovedPermanently, "/echo/201"},
+		{"GET", "/ECHO/201?x=1", http.StatusMovedPermanently, "/echo/201?x=1"},
+		{"GET", "/echo/201/.", http.StatusMovedPermanently, "/echo/201/"},
+		{"HEAD", "//ip", http.StatusMovedPermanently, "/ip"},
+		{"GET", "/echo/201", http.StatusCreated, ""},
+		// other methods are rewritten in place, a redirect would lose the body
+		{"POST", "//echo/201", http.StatusCreated, ""},
+		{"POST", "/EcHo/202", http.StatusAccepted, ""},
+		{"POST", "/echo/../echo/201", http.StatusCreated, ""},
+		// file paths keep their case
+		{"GET", "/Bar/File.TXT", http.StatusOK, ""},
+		{"GET", "/bar/file.txt", http.StatusNotFound, ""},
+		{"GET", "//Bar/File.TXT", http.StatusMovedPermanently, "/Bar/File.TXT"},
+	} {
+		status, _, header := do(t, tc.method, srv.URL+tc.path, nil)
+		if status != tc.status || header.Get("Location") != tc.location {
+			t.Errorf("%s %s: status %d, location %q, want %d %q", tc.method, tc.path, status, header.Get("Location"), tc.status, tc.location)
+		}
+	}
+
+	// utility routes only fold with -foldcase, the rest is normalized either way
+	srv, _ = newTestServer(t)
+	if status, _, _ := do(t, "GET", srv.URL+"/Echo/201", nil); status != http.StatusNotFound {
+		t.Errorf("/Echo/201 without -foldcase: status %d", status)
+	}
+	if _, _, header := do(t, "GET", srv.URL+"//echo/201", nil); header.Get("Location") != "/echo/201" {
+		t.Errorf("//echo/201 without -foldcase: location %q", header.Get("Location"))
+	}
+
+	for in, want := range map[string]string{
+		"/":          "/",
+		"":           "/",
+		"/a/./b/":    "/a/b/",
+		"/a/b/..":    "/a",
+		"/../..":     "/",
+		"/tree/./x/": "/tree/x/",
+	} {
+		if got := normalizePath(in); got != want {
+			t.Errorf("normalizePath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestTmpDir(t *testing.T) {
+	tmp := t.TempDir()
+	srv, root := newTestServer(t, "-tmpdir", tmp, "-filemode", "0640")
+
+	check := func(name, content string) {
+		t.Helper()
+		if status, body, _ := uploadForm(t, srv.URL+"/upload/in/", nil, name, content); status != http.StatusOK {
+			t.Fatalf("upload %s: status %d: %s", name, status, body)
+		}
+		fullpath := filepath.Join(root, "in", name)
+		if data, err := os.ReadFile(fullpath); err != nil || string(data) != content {
+			t.Errorf("%s: %q, %v", name, data, err)
+		}
+		if fi, err := os.Stat(fullpath); err == nil && runtime.GOOS != "windows" && fi.Mode().Perm() != 0640 {
+			t.Errorf("%s: mode %v", name, fi.Mode().Perm())
+		}
+		// nothing staged is left, neither in -tmpdir nor next to the upload
+		if files, _ := os.ReadDir(tmp); len(files) != 0 {
+			t.Errorf("%s: %s left in -tmpdir", name, files[0].Name())
+		}
+		if parts, _ := filepath.Glob(filepath.Join(root, "in", "*.part")); len(parts) != 0 {
+			t.Errorf("%s: %v left in dir", name, parts)
+		}
+	}
+
+	// same filesystem, renamed in place
+	var renames []string
+	rename = func(src, dst string) error {
+		renames = append(renames, filepath.Dir(src))
+		return os.Rename(src, dst)
+	}
+	defer func() { rename = os.Rename }()
+	check("same.txt", "renamed")
+	if len(renames) != 1 || renames[0] != tmp {
+		t.Errorf("renames from %v, want one from -tmpdir", renames)
+	}
+
+	// another device, copied next to the destination and renamed there
+	renames = nil
+	rename = func(src, dst string) error {
+		renames = append(renames, filepath.Dir(src))
+		if filepath.Dir(src) == tmp {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EXDEV}
+		}
+		return os.Rename(src, dst)
+	}
+	check("cross.txt", strings.Repeat("copied\n", 1000))
+	if len(renames) != 2 || renames[1] != filepath.Join(root, "in") {
+		t.Errorf("renames from %v, want -tmpdir then the destination", renames)
+	}
+
+	// other errors are not mistaken for a cross-device rename
+	rename = func(src, dst string) error {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EACCES}
+	}
+	src := filepath.Join(tmp, "kept")
+	writeFile(t, src, "kept")
+	if err := moveFile(src, filepath.Join(root, "kept")); err == nil {
+		t.Error("rename error swallowed")
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("source removed after a failed move: %v", err)
+	}
+}
+
+// a reader handing out data with a pause before each chunk
+type slowReader struct {
+	chunks []string
+	pause  time.Duration
+}
+
+func (s *slowReader) Read(b []byte) (int, error) {
+	if len(s.chunks) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(s.pause)
+	n := copy(b, s.chunks[0])
+	if s.chunks[0] = s.chunks[0][n:]; s.chunks[0] == "" {
+		s.chunks = s.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestTransferMetrics(t *testing.T) {
+	srv, root := newTestServer(t)
+	writeFile(t, filepath.Join(root, "a.txt"), "download me")
+
+	body := &slowReader{chunks: []string{"slow ", "upload ", "body"}, pause: 120 * time.Millisecond}
+	if status, resp, _ := do(t, "PUT", srv.URL+"/upload/slow.txt", body); status != http.StatusOK {
+		t.Fatalf("upload: status %d: %s", status, resp)
+	}
+	for i := 0; i < 3; i++ {
+		do(t, "GET", srv.URL+"/ts", nil)
+	}
+	if status, _, _ := do(t, "GET", srv.URL+"/a.txt", nil); status != http.StatusOK {
+		t.Fatalf("download: status %d", status)
+	}
+
+	samples := map[string]float64{}
+	for _, line := range strings.Split(scrape(t, srv.URL), "\n") {
+		if m := regexp.MustCompile(`^(gofs_transfer_seconds_\w+)\{app="gofs", (op="\w+")(?:, le="([^"]+)")?\} (\S+)$`).FindStringSubmatch(line); m != nil {
+			v, _ := strconv.ParseFloat(m[4], 64)
+			samples[m[1]+" "+m[2]+" "+m[3]] = v
+		}
+	}
+	if samples[`gofs_transfer_seconds_count op="upload" `] != 1 || samples[`gofs_transfer_seconds_count op="download" `] != 1 {
+		t.Fatalf("transfer counts %v", samples)
+	}
+	// the slow upload lands in the slow buckets only, the download in the fast ones
+	if sum := samples[`gofs_transfer_seconds_sum op="upload" `]; sum < 0.3 {
+		t.Errorf("upload sum %g, want at least 0.3", sum)
+	}
+	if samples[`gofs_transfer_seconds_bucket op="upload" 0.25`] != 0 || samples[`gofs_transfer_seconds_bucket op="upload" +Inf`] != 1 {
+		t.Errorf("upload buckets %v", samples)
+	}
+	if samples[`gofs_transfer_seconds_bucket op="download" 0.25`] != 1 {
+		t.Errorf("download buckets %v", samples)
+	}
+	// utility calls are counted as requests, not as transfers
+	for key := range samples {
+		if !strings.Contains(key, `op="upload"`) && !strings.Contains(key, `op="download"`) {
+			t.Errorf("unexpected transfer series %s", key)
+		}
+	}
+	if text := scrape(t, srv.URL); !strings.Contains(text, `gofs_request_total{app="gofs", path="/ts"} 3`) {
+		t.Errorf("no /ts requests in\n%s", text)
+	}
+}
+
+func TestEmptyMessage(t *testing.T) {
+	srv, root := newTestServer(t)
+	_, page, _ := do(t, "GET", srv.URL+"/", nil)
+	if !strings.Contains(page, "<p>This directory is empty. <a href=\"upload\">Upload a file</a></p>") || strings.Contains(page, "<table>") {
+		t.Errorf("empty root:\n%s", page)
+	}
+	if _, body, _ := do(t, "GET", srv.URL+"/", nil, "Accept", "application/json"); !strings.Contains(body, `"entries":[]`) {
+		t.Errorf("empty root json: %s", body)
+	}
+
+	srv, _ = newTestServer(t, "-emptymessage", "Nothing <here> yet.", "-readonly")
+	_, page, _ = do(t, "GET", srv.URL+"/", nil)
+	if !strings.Contains(page, "<p>Nothing &lt;here&gt; yet.</p>") || strings.Contains(page, "Upload a file") {
+		t.Errorf("custom message, read-only:\n%s", page)
+	}
+
+	srv, _ = newTestServer(t, "-emptymessage", "")
+	if _, page, _ = do(t, "GET", srv.URL+"/", nil); !strings.Contains(page, "<table>") {
+		t.Errorf("-emptymessage \"\" shows no bare listing:\n%s", page)
+	}
+
+	// normal listings once there is something, and for empty subdirectories
+	srv, root = newTestServer(t)
+	writeFile(t, filepath.Join(root, "a.txt"), "a")
+	os.Mkdir(filepath.Join(root, "empty"), 0755)
+	for _, target := range []string{"/", "/empty/", "/?type=file&ext=pdf"} {
+		_, page, _ := do(t, "GET", srv.URL+target, nil)
+		if strings.Contains(page, "This directory is empty.") || !strings.Contains(page, "<table>") {
+			t.Errorf("GET %s:\n%s", target, page)
+		}
+	}
+	if _, page, _ = do(t, "GET", srv.URL+"/", nil); !strings.Contains(page, `<a href="a.txt">a.txt</a>`) {
+		t.Errorf("root listing:\n%s", page)
+	}
+}
+
+func TestRandomEndpoints(t *testing.T) {
+	sequence := func(srv *httptest.Server, between func()) []string {
+		var out []string
+		for _, p := range []string{"/randstr/32", "/randint/1000000", "/uuid", "/randstr", "/randstr/0"} {
+			status, body, _ := do(t, "GET", srv.URL+p, nil)
+			if status != http.StatusOK {
+				t.Fatalf("GET %s: status %d: %s", p, status, body)
+			}
+			out = append(out, body)
+			between()
+		}
+		return out
+	}
+
+	// a fixed -seed is reproducible, even with -chaos and metric scrapes drawing from their own source
+	srv, _ := newTestServer(t, "-seed", "42")
+	first := sequence(srv, func() {})
+	srv, _ = newTestServer(t, "-seed", "42", "-chaoserror", "1e-9")
+	second := sequence(srv, func() { scrape(t, srv.URL) })
+	if strings.Join(first, "\n") != strings.Join(second, "\n") {
+		t.Errorf("seed 42 gave\n%v\nthen\n%v", first, second)
+	}
+	if len(first[0]) != 32 || len(first[3]) != 12 || !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`).MatchString(first[2]) {
+		t.Errorf("outputs %v", first)
+	}
+	srv, _ = newTestServer(t, "-seed", "43")
+	if other := sequence(srv, func() {}); other[0] == first[0] {
+		t.Errorf("seeds 42 and 43 both gave %s", other[0])
+	}
+
+	// the source is injected, handlers of another Server draw from theirs
+	injected := &Server{Rand: newLockedRand(42)}
+	rec := httptest.NewRecorder()
+	injected.randstr(rec, httptest.NewRequest("GET", "/randstr/32", nil))
+	if rec.Body.String() != first[0] {
+		t.Errorf("injected seed 42 gave %q, want %q", rec.Body.String(), first[0])
+	}
+
+	for _, p := range []string{"/randint/0", "/randint/-5", "/randstr/-1", "/randstr/99999999999"} {
+		if status, body, _ := do(t, "GET", srv.URL+p, nil); status != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d: %s", p, status, body)
+		}
+	}
+	if _, body, _ := do(t, "GET", srv.URL+"/randint/1", nil); body != "0" {
+		t.Errorf("/randint/1: %q", body)
+	}
+
+	// concurrent draws share the locked source, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, p := range []string{"/randstr/16", "/randint/10", "/uuid", "/metrics"} {
+				if status, _, _ := do(t, "GET", srv.URL+p, nil); status != http.StatusOK {
+					t.Errorf("GET %s: status %d", p, status)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMetricsState(t *testing.T) {
+	srv, root := newTestServer(t, "-metricsstate", "metrics.json")
+	for i := 0; i < 3; i++ {
+		do(t, "GET", srv.URL+"/ts", nil)
+	}
+	writeFile(t, filepath.Join(root, "a.txt"), "a")
+	do(t, "GET", srv.URL+"/a.txt", nil)
+	saveMetrics()
+
+	// the state file lives in the root, organize leaves it there
+	state := filepath.Join(root, "metrics.json")
+	old := time.Now().AddDate(0, -1, 0)
+	os.Chtimes(state, old, old)
+	organizeOnce()
+	if _, err := os.Stat(state); err != nil {
+		t.Fatalf("state file organized away: %v", err)
+	}
+	if _, err := os.Stat(state + ".part"); err == nil {
+		t.Error("temp file of the snapshot left")
+	}
+
+	// a restart restores the counters, new requests add to them
+	srv, _ = newTestServer(t, "-dir", root, "-metricsstate", "metrics.json")
+	do(t, "GET", srv.URL+"/ts", nil)
+	text := scrape(t, srv.URL)
+	for _, want := range []string{
+		`gofs_request_total{app="gofs", path="/ts"} 4`,
+		`gofs_downloads_total{app="gofs", ext="txt"} 1`,
+		`gofs_transfer_seconds_count{app="gofs", op="download"} 1`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("no %s after the restart in\n%s", want, text)
+		}
+	}
+
+	// a corrupt state file is reported and ignored
+	writeFile(t, state, `{"total": {"/ts": "many"`)
+	logs := captureLog(t)
+	srv, _ = newTestServer(t, "-dir", root, "-metricsstate", "metrics.json")
+	if !strings.Contains(logs.String(), "corrupt state file") {
+		t.Errorf("corrupt state not reported:\n%s", logs)
+	}
+	if text := scrape(t, srv.URL); strings.Contains(text, `path="/ts"`) {
+		t.Errorf("counters from a corrupt state file:\n%s", text)
+	}
+	saveMetrics()
+	var snap metricsSnapshot
+	if data, _ := os.ReadFile(state); json.Unmarshal(data, &snap) != nil || snap.Total["/metrics"] != 1 {
+		t.Errorf("state file not replaced: %s", data)
+	}
+}
+
+// response writer reporting its first write and blocking it until the gate is closed
+type gateWriter struct {
+	*httptest.ResponseRecorder
+	started chan *gateWriter
+	gate    chan struct{}
+	once    sync.Once
+}
+
+func (g *gateWriter) Write(b []byte) (int, error) {
+	g.once.Do(func() { g.started <- g })
+	<-g.gate
+	return g.ResponseRecorder.Write(b)
+}
+
+func TestWalkers(t *testing.T) {
+	srv, root := newTestServer(t, "-walkers", "2")
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 3; j++ {
+			writeFile(t, filepath.Join(root, fmt.Sprintf("d%d", i), fmt.Sprintf("f%d.bin", j)), fmt.Sprint(i, j))
+		}
+	}
+
+	// a walk waits while the slots are taken
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := acquireWalk(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+	if text := scrape(t, srv.URL); !strings.Contains(text, `gofs_walks_active{app="gofs"} 2`) {
+		t.Errorf("walks active:\n%s", text)
+	}
+	done := make(chan int, 1)
+	go func() {
+		status, _, _ := do(t, "GET", srv.URL+"/tree/d0", nil)
+		done <- status
+	}()
+	select {
+	case status := <-done:
+		t.Fatalf("walk ran with all slots taken: status %d", status)
+	case <-time.After(100 * time.Millisecond):
+	}
+	releases[0]()
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("queued walk: status %d", status)
+	}
+	releases[1]()
+
+	// a client going away while queued gives up its place
+	release, _ := acquireWalk(context.Background())
+	release2, _ := acquireWalk(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := acquireWalk(ctx); err == nil {
+		t.Error("acquired a third slot")
+	}
+	release()
+	release2()
+
+	// concurrent manifests and trees never walk more than -walkers at a time,
+	// each one holds its slot until the test lets its response through
+	started := make(chan *gateWriter)
+	finished := make(chan struct{})
+	const n = 6
+	for i := 0; i < n; i++ {
+		handler, route := tree, "/tree"
+		if i%2 == 1 {
+			handler, route = manifest, "/manifest"
+		}
+		w := &gateWriter{ResponseRecorder: httptest.NewRecorder(), started: started, gate: make(chan struct{})}
+		r := httptest.NewRequest("GET", fmt.Sprintf("%s/d%d", route, i), nil)
+		go func() {
+			handler(w, r)
+			finished <- struct{}{}
+		}()
+	}
+	var held []*gateWriter
+	for done := 0; done < n; {
+		select {
+		case w := <-started:
+			held = append(held, w)
+			if active := atomic.LoadInt64(&walksActive); active > 2 || len(held) > 2 {
+				t.Fatalf("%d walks active, %d responses held, want at most 2", active, len(held))
+			}
+		case <-finished:
+			done++
+		case <-time.After(100 * time.Millisecond):
+			// the others are queued, let one response through
+			if len(held) == 0 {
+				t.Fatal("no walk running")
+			}
+			if done+len(held) < n && len(held) < 2 {
+				t.Fatalf("%d walks running while %d are queued", len(held), n-done-len(held))
+			}
+			close(held[0].gate)
+			held = held[1:]
+		}
+	}
+	if active := atomic.LoadInt64(&walksActive); active != 0 {
+		t.Errorf("%d walks still active", active)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDirModeUmask(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(077))
+	srv, root := newTestServer(t, "-filemode", "0644", "-dirmode", "0755")
+
+	if status, body, _ := uploadForm(t, srv.URL+"/upload", map[string]string{"path": "up/load"}, "a.txt", "a"); status != http.StatusOK {
+		t.Fatalf("upload: status %d: %s", status, body)
+	}
+	if status, body, _ := postForm(t, srv.URL+"/move", url.Values{"src": {"up/load/a.txt"}, "dst": {"mo/ved/a.txt"}}); status != http.StatusOK {
+		t.Fatalf("move: status %d: %s", status, body)
+	}
+	for name, want := range map[string]os.FileMode{"up": 0755, "up/load": 0755, "mo": 0755, "mo/ved": 0755, "mo/ved/a.txt": 0644} {
+		fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != want {
+			t.Errorf("%s mode %o under umask 077, want %o", name, fi.Mode().Perm(), want)
+		}
+	}
+
+	// existing directories keep their mode
+	os.Chmod(root, 0700)
+	if err := mkdirAll(filepath.Join(root, "new")); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(root); fi.Mode().Perm() != 0700 {
+		t.Errorf("existing dir chmodded to %o", fi.Mode().Perm())
+	}
+}
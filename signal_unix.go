@@ -0,0 +1,77 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// signals re-taking the -snapshot
+var snapshotSignals = []os.Signal{syscall.SIGUSR1}
+
+// signals starting a new gofs on the same listeners while this one drains
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+// set for a restarted gofs to the comma separated addresses of its
+// inherited listeners, the first one is fd 3, the next fd 4 and so on
+const listenerEnv = "GOFS_LISTENERS"
+
+// the inherited listener of addr after a graceful restart, a new one otherwise
+func listen(addr string) (net.Listener, error) {
+	if inherited := os.Getenv(listenerEnv); inherited != "" {
+		for i, a := range strings.Split(inherited, ",") {
+			if a == addr {
+				f := os.NewFile(uintptr(3+i), "listener")
+				defer f.Close()
+				return net.FileListener(f)
+			}
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// start this binary again with the same arguments, handing over the listeners by address
+func restart(listeners map[string]net.Listener) error {
+	addrs := make([]string, 0, len(listeners))
+	for addr := range listeners {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, addr := range addrs {
+		tl, ok := listeners[addr].(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("cannot pass a %T listener", listeners[addr])
+		}
+		f, err := tl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), listenerEnv+"="+strings.Join(addrs, ","))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files // fd 3 on
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
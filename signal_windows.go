@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// there is no SIGUSR1 on windows, the -snapshot is only taken at startup
+var snapshotSignals = []os.Signal{}
+
+// nor SIGUSR2, there is no graceful restart
+var restartSignals = []os.Signal{}
+
+func listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func restart(listeners map[string]net.Listener) error {
+	return errors.New("graceful restart is not supported on windows")
+}